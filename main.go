@@ -20,20 +20,29 @@ func main() {
 	activateLogger()
 
 	// check command-line arguments
-	main := make(map[string]func())
-	main["bot"] = tower.RunBot
-	main["launch"] = tent.RunLauncher
-	main["dispatch"] = tower.RunDispatcher
 	var command string
 	if len(os.Args) > 1 {
 		command = os.Args[1]
 	}
+	err := share.StartTelemetry(command)
+	if err != nil {
+		slog.Error("Error starting telemetry", "err", err)
+		panic(err)
+	}
+	main := make(map[string]func())
+	main["bot"] = tower.RunBot
+	main["launch"] = tent.RunLauncher
+	main["dispatch"] = tower.RunDispatcher
+	main["provision"] = tower.RunProvision
+	main["teardown"] = tower.RunTeardown
+	main["userdata"] = tower.RunUserData
 	f, ok := main[command]
 	if !ok {
 		usage()
 		os.Exit(1)
 	}
 	f()
+	share.FlushTracing()
 
 	slog.Info("Exiting cleanly", "elapsed", timer)
 }
@@ -51,6 +60,12 @@ func loadDotEnv() {
 		slog.Error("Error loading .env file", "err", err)
 		panic(err)
 	}
+	// the tent's mt.env may only say where the real settings are kept
+	err = share.LoadConfigStore()
+	if err != nil {
+		slog.Error("Error loading config store", "err", err)
+		panic(err)
+	}
 }
 
 func activateLogger() {
@@ -66,6 +81,13 @@ func activateLogger() {
 		level = slog.LevelError
 	}
 
+	// JOURNAL_STREAM is set when systemd hooks stderr up to the journal
+	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
+	if format == "journald" || (format == "" && os.Getenv("JOURNAL_STREAM") != "") {
+		slog.SetDefault(slog.New(share.NewJournaldHandler(os.Stderr, level)))
+		return
+	}
+
 	// color my world 💖
 	slog.SetDefault(slog.New(tint.NewHandler(os.Stderr, &tint.Options{
 		Level:      level,
@@ -76,7 +98,10 @@ func activateLogger() {
 func usage() {
 	fmt.Printf("Usage: %s <mode>\n", os.Args[0])
 	fmt.Println("Modes:")
-	fmt.Println("  bot      - Run the bot")
-	fmt.Println("  launch   - Launch the server")
-	fmt.Println("  dispatch - Dispatch the server")
+	fmt.Println("  bot       - Run the bot")
+	fmt.Println("  launch    - Launch the server")
+	fmt.Println("  dispatch  - Dispatch the server")
+	fmt.Println("  provision - Set up the AWS resources the server needs")
+	fmt.Println("  teardown  - Release the elastic IP and delete the stored tent settings")
+	fmt.Println("  userdata  - Print the instance user-data for review")
 }
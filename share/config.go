@@ -0,0 +1,87 @@
+package share
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Where the tower keeps the tent's settings, so they stay out of the instance's user-data.
+const (
+	ConfigStoreSSM            = "ssm"
+	ConfigStoreSecretsManager = "secretsmanager"
+	ConfigStoreUserData       = "userdata"
+)
+
+// LoadConfigStore fills in the environment from the store named by MT_CONFIG_STORE and MT_CONFIG_PATH.
+// Settings that are already set win. Without MT_CONFIG_STORE it does nothing.
+func LoadConfigStore() error {
+	store := os.Getenv("MT_CONFIG_STORE")
+	path := os.Getenv("MT_CONFIG_PATH")
+	var settings map[string]string
+	var err error
+	switch store {
+	case "", ConfigStoreUserData:
+		return nil
+	case ConfigStoreSSM:
+		settings, err = readParameters(path)
+	case ConfigStoreSecretsManager:
+		settings, err = readSecret(path)
+	default:
+		return fmt.Errorf("unknown MT_CONFIG_STORE: %s", store)
+	}
+	if err != nil {
+		return err
+	}
+	for key, value := range settings {
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, value)
+		}
+	}
+	return nil
+}
+
+func configSession() *session.Session {
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))},
+	}))
+}
+
+func readParameters(path string) (map[string]string, error) {
+	settings := make(map[string]string)
+	err := ssm.New(configSession()).GetParametersByPathPages(&ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		WithDecryption: aws.Bool(true),
+	}, func(page *ssm.GetParametersByPathOutput, _ bool) bool {
+		for _, parameter := range page.Parameters {
+			settings[strings.TrimPrefix(*parameter.Name, path)] = *parameter.Value
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading parameters under %s: %w", path, err)
+	}
+	return settings, nil
+}
+
+func readSecret(name string) (map[string]string, error) {
+	resp, err := secretsmanager.New(configSession()).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading secret %s: %w", name, err)
+	}
+	var settings map[string]string
+	err = json.Unmarshal([]byte(aws.StringValue(resp.SecretString)), &settings)
+	if err != nil {
+		return nil, fmt.Errorf("parsing secret %s: %w", name, err)
+	}
+	return settings, nil
+}
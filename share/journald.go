@@ -0,0 +1,79 @@
+package share
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// journaldHandler writes logfmt lines prefixed with a syslog priority like <6>, which journald
+// picks up from a unit's stdout. The journal keeps its own timestamps, so there's no time field.
+type journaldHandler struct {
+	inner  slog.Handler
+	writer *priorityWriter
+}
+
+// priorityWriter prefixes each record's line with the priority of the record being written.
+type priorityWriter struct {
+	mutex    sync.Mutex
+	out      io.Writer
+	priority int
+}
+
+func (w *priorityWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(w.out, "<"+strconv.Itoa(w.priority)+">")
+	if err != nil {
+		return 0, err
+	}
+	return w.out.Write(p)
+}
+
+func NewJournaldHandler(out io.Writer, level slog.Leveler) slog.Handler {
+	writer := &priorityWriter{out: out}
+	return &journaldHandler{
+		writer: writer,
+		inner: slog.NewTextHandler(writer, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+	}
+}
+
+func journaldPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func (h *journaldHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *journaldHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.writer.mutex.Lock()
+	defer h.writer.mutex.Unlock()
+	h.writer.priority = journaldPriority(r.Level)
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &journaldHandler{inner: h.inner.WithAttrs(attrs), writer: h.writer}
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	return &journaldHandler{inner: h.inner.WithGroup(name), writer: h.writer}
+}
@@ -0,0 +1,155 @@
+package share
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// MetricKind is the OpenTelemetry instrument behind a metric.
+type MetricKind string
+
+const (
+	Counter   MetricKind = "counter"
+	Gauge     MetricKind = "gauge"
+	Histogram MetricKind = "histogram"
+)
+
+// meter is where the tower's and the tent's instruments come from. Until StartTelemetry sets up the SDK, they record nothing.
+var meter = otel.Meter("mansionTent")
+
+// registry only holds what the SDK's Prometheus exporter collects, so /metrics is just this process's instruments.
+var registry = prometheus.NewRegistry()
+
+var metricsHandler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+// startMetrics has the SDK collect instruments for scraping. There's nothing to push, so it's always on.
+func startMetrics(res *resource.Resource) error {
+	exporter, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+	if err != nil {
+		return fmt.Errorf("creating metrics exporter: %w", err)
+	}
+	otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter), sdkmetric.WithResource(res)))
+	return nil
+}
+
+// Metrics keeps instruments by name, so call sites can record with a name and label pairs.
+type Metrics struct {
+	mutex       sync.Mutex
+	instruments map[string]any
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{instruments: make(map[string]any)}
+}
+
+// Describe declares a metric. Counter names should end in _total, as Prometheus shows them that way regardless.
+func (m *Metrics) Describe(name string, kind MetricKind, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.instruments[name]; ok {
+		return
+	}
+	var instrument any
+	var err error
+	switch kind {
+	case Counter:
+		instrument, err = meter.Float64Counter(name, metric.WithDescription(help))
+	case Gauge:
+		instrument, err = meter.Float64Gauge(name, metric.WithDescription(help))
+	case Histogram:
+		instrument, err = meter.Float64Histogram(name, metric.WithDescription(help))
+	default:
+		err = fmt.Errorf("unknown kind %q", kind)
+	}
+	if err != nil {
+		slog.Error("Error describing metric", "metric", name, "err", err)
+		return
+	}
+	m.instruments[name] = instrument
+}
+
+// Observer reports one value of an observed metric.
+type Observer func(value float64, labels ...string)
+
+// DescribeObserved declares a counter or gauge whose values read reports each time the metrics are scraped,
+// for things like CPU time that are only worth reading when someone asks.
+func (m *Metrics) DescribeObserved(name string, kind MetricKind, help string, read func(observe Observer)) {
+	callback := metric.WithFloat64Callback(func(_ context.Context, observer metric.Float64Observer) error {
+		read(func(value float64, labels ...string) {
+			observer.Observe(value, attributes(labels))
+		})
+		return nil
+	})
+	var err error
+	switch kind {
+	case Counter:
+		_, err = meter.Float64ObservableCounter(name, metric.WithDescription(help), callback)
+	case Gauge:
+		_, err = meter.Float64ObservableGauge(name, metric.WithDescription(help), callback)
+	default:
+		err = fmt.Errorf("kind %q can't be observed", kind)
+	}
+	if err != nil {
+		slog.Error("Error describing metric", "metric", name, "err", err)
+	}
+}
+
+// attributes turns label pairs like "kind", "save" into instrument attributes.
+func attributes(labels []string) metric.MeasurementOption {
+	pairs := make([]attribute.KeyValue, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, attribute.String(labels[i], labels[i+1]))
+	}
+	return metric.WithAttributes(pairs...)
+}
+
+// instrument finds a metric's instrument. A measurement of an undeclared metric, or as the wrong kind, is a bug,
+// but not one worth taking the game down mid-session for, so it's logged and dropped.
+func instrument[T any](m *Metrics, name string) (T, bool) {
+	m.mutex.Lock()
+	found, declared := m.instruments[name]
+	m.mutex.Unlock()
+	typed, ok := found.(T)
+	if !ok {
+		slog.Error("Dropping measurement of undeclared metric, or one of another kind", "metric", name, "declared", declared)
+	}
+	return typed, ok
+}
+
+// Add increases a counter.
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+	if counter, ok := instrument[metric.Float64Counter](m, name); ok {
+		counter.Add(context.Background(), delta, attributes(labels))
+	}
+}
+
+// Set sets a gauge.
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	if gauge, ok := instrument[metric.Float64Gauge](m, name); ok {
+		gauge.Record(context.Background(), value, attributes(labels))
+	}
+}
+
+// Observe records one value of a histogram.
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	if histogram, ok := instrument[metric.Float64Histogram](m, name); ok {
+		histogram.Record(context.Background(), value, attributes(labels))
+	}
+}
+
+// ServeHTTP serves what the exporter collected in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metricsHandler.ServeHTTP(w, r)
+}
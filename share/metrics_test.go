@@ -0,0 +1,69 @@
+package share
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scraped is the value of the first series in body that starts with prefix.
+func scraped(body, prefix string) (string, bool) {
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			fields := strings.Fields(line)
+			return fields[len(fields)-1], true
+		}
+	}
+	return "", false
+}
+
+func TestMetricsServeWhatWasRecorded(t *testing.T) {
+	metrics := NewMetrics()
+	// instruments declared before the SDK starts, like the packages' init, still get recorded
+	metrics.Describe("test_saves_total", Counter, "Saves.")
+	metrics.Describe("test_players", Gauge, "Players.")
+	metrics.Describe("test_save_seconds", Histogram, "Save time.")
+	metrics.DescribeObserved("test_cpu_seconds_total", Counter, "CPU time.", func(observe Observer) {
+		observe(12.5, "process", "game")
+	})
+	err := StartTelemetry("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics.Add("test_saves_total", 1, "kind", "auto")
+	metrics.Add("test_saves_total", 2, "kind", "auto")
+	metrics.Set("test_players", 4)
+	metrics.Set("test_players", 3)
+	metrics.Observe("test_save_seconds", 2)
+	metrics.Observe("test_save_seconds", 3)
+
+	response := httptest.NewRecorder()
+	metrics.ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+	body := response.Body.String()
+	for prefix, want := range map[string]string{
+		`test_saves_total{`:        "3",
+		`test_players{`:            "3",
+		`test_save_seconds_sum{`:   "5",
+		`test_save_seconds_count{`: "2",
+		`test_cpu_seconds_total{`:  "12.5",
+		`target_info{`:             "1",
+	} {
+		got, ok := scraped(body, prefix)
+		if got != want {
+			t.Errorf("%s… = %q (found %v), want %s", prefix, got, ok, want)
+		}
+	}
+	for _, label := range []string{`kind="auto"`, `process="game"`, `service_name="mansionTent"`} {
+		if !strings.Contains(body, label) {
+			t.Errorf("no %s in:\n%s", label, body)
+		}
+	}
+}
+
+func TestMetricsDropBadMeasurements(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.Describe("test_gauge", Gauge, "A gauge.")
+	// neither of these should take the process down
+	metrics.Add("test_undeclared_total", 1)
+	metrics.Observe("test_gauge", 1)
+}
@@ -22,3 +22,11 @@ func (s *Set[V]) Remove(v V) {
 func (s *Set[V]) Len() int {
 	return len(s.data)
 }
+
+func (s *Set[V]) Values() []V {
+	values := make([]V, 0, len(s.data))
+	for v := range s.data {
+		values = append(values, v)
+	}
+	return values
+}
@@ -0,0 +1,56 @@
+package share
+
+import (
+	"os"
+	"time"
+)
+
+// ServerState is the coarse phase of a tent, as shown to players.
+type ServerState string
+
+const (
+	StateStopped     ServerState = "stopped"
+	StateLaunching   ServerState = "launching"
+	StateDownloading ServerState = "downloading"
+	StateInGame      ServerState = "in game"
+	StateDraining    ServerState = "draining"
+)
+
+// Progress is how far along one boot task is. Total is zero when there's no way to tell.
+type Progress struct {
+	Task  string `json:"task"`
+	Done  int64  `json:"done"`
+	Total int64  `json:"total"`
+	Unit  string `json:"unit,omitempty"`
+}
+
+// Status is what the tent reports on its control port.
+type Status struct {
+	State    ServerState `json:"state"`
+	Players  []string    `json:"players"`
+	Version  string      `json:"version"`
+	Started  time.Time   `json:"started"`
+	Progress []Progress  `json:"progress,omitempty"`
+}
+
+// SaveResult is what the tent reports once a save it was asked for has been uploaded.
+type SaveResult struct {
+	File     string        `json:"file,omitempty"`
+	Size     int64         `json:"size"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// ControlPort is the TCP port the tent listens on for the tower.
+func ControlPort() string {
+	port := os.Getenv("CONTROL_PORT")
+	if port == "" {
+		port = "34200"
+	}
+	return port
+}
+
+// ControlToken is the shared secret the tower must present to the tent.
+func ControlToken() string {
+	return os.Getenv("CONTROL_TOKEN")
+}
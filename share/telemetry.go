@@ -0,0 +1,31 @@
+package share
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// StartTelemetry sets up the OpenTelemetry SDK for metrics and, if OTEL_TRACES_EXPORTER asks for it, tracing.
+// Both describe the process the same way, as mansionTent in this mode, plus the usual OTEL_RESOURCE_ATTRIBUTES.
+func StartTelemetry(mode string) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName("mansionTent"), attribute.String("mansionTent.mode", mode)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return fmt.Errorf("creating telemetry resource: %w", err)
+	}
+	err = startMetrics(res)
+	if err != nil {
+		return err
+	}
+	return startTracing(res)
+}
@@ -0,0 +1,75 @@
+package share
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer is where the tower's and the tent's spans come from. Until StartTelemetry sets up an exporter, spans go nowhere.
+var Tracer = otel.Tracer("mansionTent")
+
+var traceProvider *sdktrace.TracerProvider
+
+// startTracing exports spans as OTEL_TRACES_EXPORTER says: otlp, which follows the usual OTEL_EXPORTER_OTLP_*
+// settings, or console for stdout. Anything else leaves tracing off.
+func startTracing(res *resource.Resource) error {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "console":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("creating trace exporter: %w", err)
+	}
+	traceProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(traceProvider)
+	return nil
+}
+
+// FlushTracing sends off any spans still waiting, e.g. right before the machine powers off.
+func FlushTracing() {
+	if traceProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	traceProvider.ForceFlush(ctx)
+}
+
+// Traceparent is the W3C trace context header for ctx, to continue its trace on another machine.
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// TraceContext continues the trace in TRACEPARENT, if the tower left one.
+func TraceContext() context.Context {
+	carrier := propagation.MapCarrier{"traceparent": os.Getenv("TRACEPARENT")}
+	return propagation.TraceContext{}.Extract(context.Background(), carrier)
+}
+
+// EndSpan records err on the span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
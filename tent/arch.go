@@ -0,0 +1,55 @@
+package tent
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+var ErrNoEmulator = errors.New("no x86-64 emulator found")
+
+// gamePlatforms lists the headless builds to try, best first.
+// On arm64 the native build is preferred; the x86-64 one is the fallback and needs an emulator.
+func gamePlatforms() []string {
+	if runtime.GOARCH == "arm64" {
+		native := os.Getenv("FACTORIO_ARM64_PLATFORM")
+		if native == "" {
+			native = "linux_arm64"
+		}
+		return []string{native, "linux64"}
+	}
+	return []string{"linux64"}
+}
+
+// findGameBinary returns the game executable under dir, whichever build was unpacked, or "" if there is none.
+func findGameBinary(dir string) string {
+	matches, _ := filepath.Glob(filepath.Join(dir, "bin", "*", "factorio"))
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+// gameCommand builds the command line to run the game binary on this machine,
+// going through box64 or FEX when it's an x86-64 binary on arm64.
+func gameCommand(binary string, args ...string) (*exec.Cmd, error) {
+	if runtime.GOARCH != "arm64" || filepath.Base(filepath.Dir(binary)) != "x64" {
+		return exec.Command(binary, args...), nil
+	}
+	candidates := []string{"box64", "FEXInterpreter"}
+	if configured := os.Getenv("FACTORIO_EMULATOR"); configured != "" {
+		candidates = []string{configured}
+	}
+	for _, candidate := range candidates {
+		emulator, err := exec.LookPath(candidate)
+		if err == nil {
+			slog.Info("Running x86-64 game through emulator", "emulator", emulator)
+			return exec.Command(emulator, append([]string{binary}, args...)...), nil
+		}
+	}
+	return nil, fmt.Errorf("%w, tried %v", ErrNoEmulator, candidates)
+}
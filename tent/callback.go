@@ -0,0 +1,92 @@
+package tent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mansionTent/share"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// towerCallback tells the tower about state changes as they happen, so it doesn't have to wait for
+// its next poll. Reports go out one at a time, and only the latest is sent if they pile up.
+type towerCallback struct {
+	http   *http.Client
+	url    string
+	token  string
+	mutex  sync.Mutex
+	latest *share.Status
+	wake   chan struct{}
+}
+
+// NewTowerCallback reports to MT_CALLBACK_URL, which the tower sets per launch. It's nil when that isn't set.
+func NewTowerCallback() *towerCallback {
+	url := os.Getenv("MT_CALLBACK_URL")
+	if url == "" {
+		return nil
+	}
+	c := &towerCallback{
+		http:  &http.Client{Timeout: 5 * time.Second},
+		url:   url,
+		token: share.ControlToken(),
+		wake:  make(chan struct{}, 1),
+	}
+	go c.run()
+	return c
+}
+
+func (c *towerCallback) Report(status share.Status) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.latest = &status
+	c.mutex.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *towerCallback) run() {
+	for range c.wake {
+		c.mutex.Lock()
+		status := c.latest
+		c.latest = nil
+		c.mutex.Unlock()
+		if status == nil {
+			continue
+		}
+		// a missed report only means the tower finds out on its next poll
+		err := c.post(status)
+		if err != nil {
+			slog.Debug("Error reporting state to the tower", "err", err)
+		}
+	}
+}
+
+func (c *towerCallback) post(status *share.Status) error {
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.token)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("tower callback: %s", response.Status)
+	}
+	return nil
+}
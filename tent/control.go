@@ -0,0 +1,97 @@
+package tent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mansionTent/share"
+	"net/http"
+)
+
+type control struct {
+	sitter *sitter
+	logs   *sessionLogs
+	token  string
+}
+
+func NewControl(sitter *sitter, logs *sessionLogs) *control {
+	return &control{
+		sitter: sitter,
+		logs:   logs,
+		token:  share.ControlToken(),
+	}
+}
+
+func (c *control) Run() {
+	if c.token == "" {
+		slog.Warn("CONTROL_TOKEN is not set, control port disabled")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", c.authorized(c.onStatus))
+	mux.HandleFunc("POST /stop", c.authorized(c.onStop))
+	mux.HandleFunc("POST /save", c.authorized(c.onSave))
+	mux.HandleFunc("GET /logs", c.authorized(c.onLogs))
+	mux.HandleFunc("GET /metrics", c.authorized(metrics.ServeHTTP))
+	addr := ":" + share.ControlPort()
+	slog.Info("Control port listening", "addr", addr)
+	err := http.ListenAndServe(addr, mux)
+	slog.Error("Control port closed", "err", err)
+}
+
+func (c *control) authorized(next http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + c.token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (c *control) onStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.sitter.Status())
+}
+
+func (c *control) onStop(w http.ResponseWriter, _ *http.Request) {
+	slog.Info("Stop requested through control port")
+	if !c.sitter.running() {
+		http.Error(w, "game is not running", http.StatusConflict)
+		return
+	}
+	go c.sitter.shutdown()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// onSave asks for a save. With ?wait=true it answers once the save is uploaded, with a share.SaveResult.
+func (c *control) onSave(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Save requested through control port")
+	if r.URL.Query().Get("wait") == "true" {
+		result, err := c.sitter.saveAndWait()
+		switch {
+		case errors.Is(err, ErrGameNotRunning):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+		}
+		return
+	}
+	if !c.sitter.save() {
+		http.Error(w, "game is not running", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *control) onLogs(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, c.logs.Tail())
+}
@@ -0,0 +1,221 @@
+package tent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outboxDir holds each notifier's undelivered events in the working directory, which is the data volume
+// when there is one, so a tent that crashes or loses power sends them on its next boot.
+const outboxDir = "outbox"
+
+// delivery feeds events to one notifier in order from a single worker.
+// Events that arrive close together are merged into one post, failed posts are retried with backoff,
+// and nothing is dropped just because the queue is long. The queue is kept on disk until it's delivered.
+type delivery struct {
+	notifier notifier
+	filter   map[eventKind]bool
+	path     string
+	mutex    sync.Mutex
+	wake     *sync.Cond
+	queue    []event
+	busy     bool
+	window   time.Duration
+	retries  int
+}
+
+// NewDelivery starts a worker for a notifier, after picking up whatever an earlier tent left undelivered.
+// An empty filter lets every event through.
+func NewDelivery(notifier notifier, filter map[eventKind]bool) *delivery {
+	// the launcher changes directory later, so pin the outbox down now
+	path, err := filepath.Abs(filepath.Join(outboxDir, notifier.Name()+".json"))
+	if err != nil {
+		slog.Warn("Error finding notification outbox", "sink", notifier.Name(), "err", err)
+	}
+	return newDelivery(notifier, filter, path)
+}
+
+func newDelivery(notifier notifier, filter map[eventKind]bool, path string) *delivery {
+	d := &delivery{
+		notifier: notifier,
+		filter:   filter,
+		path:     path,
+		window:   parseFloatDurationOrDefault("WEBHOOK_COALESCE_SECONDS", 2, time.Second),
+		retries:  parseIntOrDefault("WEBHOOK_MAX_RETRIES", 5),
+	}
+	d.wake = sync.NewCond(&d.mutex)
+	d.load()
+	go d.run()
+	return d
+}
+
+// load queues the events an earlier tent didn't get to deliver.
+func (d *delivery) load() {
+	if d.path == "" {
+		return
+	}
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &d.queue)
+	}
+	if err != nil {
+		slog.Warn("Error reading notification outbox", "sink", d.notifier.Name(), "err", err)
+		return
+	}
+	if len(d.queue) > 0 {
+		slog.Info("Resending undelivered notifications", "sink", d.notifier.Name(), "events", len(d.queue))
+	}
+}
+
+// save writes the queue to the outbox, replacing it in one go. The caller holds the mutex.
+func (d *delivery) save() {
+	if d.path == "" {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(d.path), 0o700)
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(d.queue)
+		if err == nil {
+			err = os.WriteFile(d.path+".tmp", data, 0o600)
+		}
+	}
+	if err == nil {
+		err = os.Rename(d.path+".tmp", d.path)
+	}
+	if err != nil {
+		slog.Warn("Error writing notification outbox", "sink", d.notifier.Name(), "err", err)
+	}
+}
+
+func (d *delivery) Enqueue(e event) {
+	if len(d.filter) > 0 && !d.filter[e.Kind] {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queue = append(d.queue, e)
+	d.save()
+	d.wake.Signal()
+}
+
+// Flush waits until everything queued so far has been delivered or given up on.
+func (d *delivery) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		d.mutex.Lock()
+		pending := len(d.queue)
+		idle := pending == 0 && !d.busy
+		d.mutex.Unlock()
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			slog.Warn("Notification queue not flushed in time", "sink", d.notifier.Name(), "pending", pending)
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (d *delivery) run() {
+	for {
+		d.mutex.Lock()
+		for len(d.queue) == 0 {
+			d.wake.Wait()
+		}
+		d.busy = true
+		d.mutex.Unlock()
+		// give a burst of joins and leaves a moment to pile up
+		time.Sleep(d.window)
+		batch := d.peek()
+		d.deliver(batch)
+		d.mutex.Lock()
+		// the batch stays queued, and on disk, until it's been delivered or given up on
+		d.queue = d.queue[len(batch):]
+		d.save()
+		d.busy = false
+		d.mutex.Unlock()
+	}
+}
+
+// peek is as many of the first queued events as the notifier accepts in one post.
+func (d *delivery) peek() []event {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	n := min(len(d.queue), d.notifier.MaxBatch())
+	return slices.Clone(d.queue[:n])
+}
+
+func (d *delivery) deliver(batch []event) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := d.notifier.Notify(batch)
+		if err == nil {
+			return
+		}
+		if retryAfter < 0 || attempt >= d.retries {
+			slog.Error("Notification dropped", "sink", d.notifier.Name(), "err", err, "attempts", attempt+1, "events", len(batch))
+			return
+		}
+		if retryAfter == 0 {
+			retryAfter = backoff
+			backoff = min(2*backoff, time.Minute)
+		}
+		slog.Warn("Notification failed, retrying", "sink", d.notifier.Name(), "err", err, "wait", retryAfter)
+		time.Sleep(retryAfter)
+	}
+}
+
+// classifyResponse turns an HTTP response into the notifier contract: on failure, retryAfter is how long
+// the server asked us to wait, zero if it didn't say, or negative if retrying won't help.
+func classifyResponse(response *http.Response) (retryAfter time.Duration, err error) {
+	switch {
+	case response.StatusCode < 300:
+		return 0, nil
+	case response.StatusCode == http.StatusTooManyRequests:
+		return rateLimitWait(response), fmt.Errorf("rate limited: %s", response.Status)
+	case response.StatusCode >= 500:
+		return 0, fmt.Errorf("server error: %s", response.Status)
+	default:
+		detail, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return -1, fmt.Errorf("rejected: %s %s", response.Status, strings.TrimSpace(string(detail)))
+	}
+}
+
+// rateLimitWait reads how long the server wants us to back off, from the body or the standard header.
+// Discord says retry_after in seconds, Matrix says retry_after_ms.
+func rateLimitWait(response *http.Response) time.Duration {
+	var limited struct {
+		RetryAfter   float64 `json:"retry_after"`
+		RetryAfterMs float64 `json:"retry_after_ms"`
+	}
+	if json.NewDecoder(response.Body).Decode(&limited) == nil {
+		if limited.RetryAfter > 0 {
+			return time.Duration(limited.RetryAfter * float64(time.Second))
+		}
+		if limited.RetryAfterMs > 0 {
+			return time.Duration(limited.RetryAfterMs * float64(time.Millisecond))
+		}
+	}
+	seconds, err := strconv.ParseFloat(response.Header.Get("Retry-After"), 64)
+	if err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return 0
+}
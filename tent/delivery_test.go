@@ -0,0 +1,89 @@
+package tent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSlack rate limits the first post with retry_after and records every post after that.
+type fakeSlack struct {
+	mutex   sync.Mutex
+	limited bool
+	times   []time.Time
+	texts   []string
+}
+
+func (f *fakeSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Text string `json:"text"`
+	}
+	json.NewDecoder(r.Body).Decode(&payload)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.times = append(f.times, time.Now())
+	if !f.limited {
+		f.limited = true
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"retry_after": 0.3}`))
+		return
+	}
+	f.texts = append(f.texts, payload.Text)
+}
+
+func (f *fakeSlack) delivered() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.texts...)
+}
+
+func TestDeliveryCoalescesAndWaitsOutRateLimits(t *testing.T) {
+	t.Setenv("WEBHOOK_COALESCE_SECONDS", "0.1")
+	fake := &fakeSlack{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	outbox := filepath.Join(t.TempDir(), "slack.json")
+	d := newDelivery(&slackNotifier{url: server.URL}, nil, outbox)
+	d.Enqueue(event{Kind: eventJoined, Text: "alice joined"})
+	d.Enqueue(event{Kind: eventJoined, Text: "bob joined"})
+	if !d.Flush(5 * time.Second) {
+		t.Fatal("delivery didn't finish")
+	}
+	got := fake.delivered()
+	if len(got) != 1 || got[0] != "alice joined\nbob joined" {
+		t.Fatalf("delivered %q, want both joins in one post", got)
+	}
+	if wait := fake.times[1].Sub(fake.times[0]); wait < 300*time.Millisecond {
+		t.Errorf("retried after %v, before the retry_after of 300ms", wait)
+	}
+	data, err := os.ReadFile(outbox)
+	if err != nil || string(data) != "[]" {
+		t.Errorf("outbox = %q, %v after delivering, want it empty", data, err)
+	}
+}
+
+func TestDeliveryResendsTheOutbox(t *testing.T) {
+	t.Setenv("WEBHOOK_COALESCE_SECONDS", "0")
+	fake := &fakeSlack{limited: true}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	outbox := filepath.Join(t.TempDir(), "slack.json")
+	// what an earlier tent left behind when it lost power
+	left, _ := json.Marshal([]event{{Kind: eventQuit, Text: "server quit"}})
+	err := os.WriteFile(outbox, left, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDelivery(&slackNotifier{url: server.URL}, nil, outbox)
+	if !d.Flush(5 * time.Second) {
+		t.Fatal("delivery didn't finish")
+	}
+	if got := fake.delivered(); len(got) != 1 || got[0] != "server quit" {
+		t.Errorf("delivered %q, want the event from the outbox", got)
+	}
+}
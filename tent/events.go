@@ -0,0 +1,110 @@
+package tent
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type eventKind string
+
+const (
+	eventLaunched eventKind = "launched"
+	eventJoined   eventKind = "joined"
+	eventLeft     eventKind = "left"
+	eventDrained  eventKind = "drained"
+	eventQuit     eventKind = "quit"
+	eventDegraded eventKind = "degraded"
+)
+
+// event is everything a message template can refer to, plus the rendered Text for the sinks.
+type event struct {
+	Kind     eventKind     `json:"kind"`
+	Time     time.Time     `json:"time"`
+	Player   string        `json:"player,omitempty"`
+	TimeLeft time.Duration `json:"time_left,omitempty"`
+	Address  string        `json:"address,omitempty"`
+	Version  string        `json:"version,omitempty"`
+	Players  int           `json:"players"`
+	UPS      float64       `json:"ups,omitempty"`
+	Entities int           `json:"entities,omitempty"`
+	Bigger   string        `json:"bigger,omitempty"` // a suggested EC2_INSTANCE_TYPE
+	Text     string        `json:"text"`
+}
+
+var eventDefaults = map[eventKind]struct {
+	template string
+	color    int
+}{
+	eventLaunched: {"Server is ready", 0x43b581},
+	eventJoined:   {"Joined: {{.Player}}", 0x3ba55c},
+	eventLeft:     {"Left: {{.Player}}", 0xfaa61a},
+	eventDrained:  {"Server is empty, shutting down in {{.TimeLeft}}", 0x5865f2},
+	eventQuit:     {"Server is destroyed! Bye!", 0x747f8d},
+	eventDegraded: {`Server is struggling at {{printf "%.1f" .UPS}} UPS{{if .Bigger}}; try EC2_INSTANCE_TYPE={{.Bigger}}{{end}}`, 0xed4245},
+}
+
+// eventFormat turns events into text.
+// Each event's text can be replaced with HOOK_TEMPLATE_<KIND>, and HOOK_EVENTS_DISABLED silences kinds entirely.
+type eventFormat struct {
+	templates map[eventKind]*template.Template
+	disabled  map[eventKind]bool
+}
+
+func NewEventFormat() *eventFormat {
+	f := &eventFormat{
+		templates: make(map[eventKind]*template.Template),
+	}
+	for kind, defaults := range eventDefaults {
+		key := "HOOK_TEMPLATE_" + strings.ToUpper(string(kind))
+		text := os.Getenv(key)
+		if text == "" {
+			text = defaults.template
+		}
+		parsed, err := template.New(string(kind)).Parse(text)
+		if err != nil {
+			slog.Warn("Invalid template, using the default", "key", key, "err", err)
+			parsed = template.Must(template.New(string(kind)).Parse(defaults.template))
+		}
+		f.templates[kind] = parsed
+	}
+	f.disabled = parseEventKinds("HOOK_EVENTS_DISABLED")
+	return f
+}
+
+func (f *eventFormat) Enabled(kind eventKind) bool {
+	return !f.disabled[kind]
+}
+
+func (f *eventFormat) Text(e event) string {
+	var buffer bytes.Buffer
+	err := f.templates[e.Kind].Execute(&buffer, e)
+	if err != nil {
+		slog.Warn("Error rendering template", "kind", e.Kind, "err", err)
+		return string(e.Kind)
+	}
+	return buffer.String()
+}
+
+func eventColor(kind eventKind) int {
+	return eventDefaults[kind].color
+}
+
+// parseEventKinds reads a comma-separated list of event kinds from the environment.
+func parseEventKinds(key string) map[eventKind]bool {
+	kinds := make(map[eventKind]bool)
+	for _, kind := range strings.Split(os.Getenv(key), ",") {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		if kind == "" {
+			continue
+		}
+		if _, ok := eventDefaults[eventKind(kind)]; !ok {
+			slog.Warn("Unknown event kind", "key", key, "kind", kind)
+		}
+		kinds[eventKind(kind)] = true
+	}
+	return kinds
+}
@@ -1,65 +1,92 @@
 package tent
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
 	"log/slog"
-	"net/http"
+	"mansionTent/share"
 	"os"
 	"time"
 )
 
 type hooks struct {
-	launcher *launcher
-	url      string
+	launcher   *launcher
+	format     *eventFormat
+	deliveries []*delivery
+	tower      *towerCallback
+	address    string
 }
 
 func NewHooks(launcher *launcher) *hooks {
 	return &hooks{
-		launcher: launcher,
-		url:      os.Getenv("WEBHOOK_URL"),
+		launcher:   launcher,
+		format:     NewEventFormat(),
+		deliveries: NewDeliveries(),
+		tower:      NewTowerCallback(),
+		address:    os.Getenv("ROUTE53_FQDN"),
 	}
 }
 
-func (h *hooks) send(message string) {
-	slog.Info("Webhook", "msg", message)
-	if h.url == "" {
+func (h *hooks) send(e event) {
+	if !h.format.Enabled(e.Kind) {
+		slog.Debug("Webhook disabled", "kind", e.Kind)
 		return
 	}
-	// send webhook
-	payload := map[string]string{"content": message}
-	body, _ := json.Marshal(payload)
-	response, err := http.Post(h.url, "application/json", bytes.NewBuffer(body))
-	if err != nil {
-		slog.Error("Webhook error", "err", err)
+	status := h.launcher.sitter.Status()
+	e.Time = time.Now()
+	e.Address = h.address
+	e.Version = status.Version
+	e.Players = len(status.Players)
+	e.Text = h.format.Text(e)
+	slog.Info("Webhook", "msg", e.Text)
+	for _, d := range h.deliveries {
+		d.Enqueue(e)
 	}
-	defer response.Body.Close()
-	if response.StatusCode != 204 {
-		slog.Error("Webhook error", "status", response.Status)
+}
+
+// flush gives queued webhooks a last chance to go out, e.g. before powering off.
+func (h *hooks) flush() {
+	deadline := time.Now().Add(time.Minute)
+	for _, d := range h.deliveries {
+		d.Flush(time.Until(deadline))
 	}
 }
 
+func (h *hooks) onStateChanged(status share.Status) {
+	h.tower.Report(status)
+}
+
 func (h *hooks) onLaunched() {
-	h.send("Server is ready")
+	h.send(event{Kind: eventLaunched})
+}
+
+func (h *hooks) onSaved() share.SaveResult {
+	return h.launcher.uploadSave()
+}
+
+func (h *hooks) onStopped() {
+	h.launcher.uploadState()
+	h.launcher.uploadLogs()
 }
 
-func (h *hooks) onSaved() {
-	h.launcher.uploadSave()
+func (h *hooks) onCrashed() {
+	h.launcher.uploadLogs()
 }
 
 func (h *hooks) onJoined(name string) {
-	h.send(fmt.Sprintf("Joined: %s", name))
+	h.send(event{Kind: eventJoined, Player: name})
 }
 
 func (h *hooks) onLeft(name string) {
-	h.send(fmt.Sprintf("Left: %s", name))
+	h.send(event{Kind: eventLeft, Player: name})
 }
 
 func (h *hooks) onDrained(timeLeft time.Duration) {
-	h.send(fmt.Sprintf("Server is empty, shutting down in %s", timeLeft.Round(time.Second)))
+	h.send(event{Kind: eventDrained, TimeLeft: timeLeft.Round(time.Second)})
+}
+
+func (h *hooks) onDegraded(ups float64, entities int, bigger string) {
+	h.send(event{Kind: eventDegraded, UPS: ups, Entities: entities, Bigger: bigger})
 }
 
 func (h *hooks) onQuit() {
-	h.send("Server is destroyed! Bye!")
+	h.send(event{Kind: eventQuit})
 }
@@ -0,0 +1,138 @@
+package tent
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var ErrBadSave = errors.New("save is damaged")
+
+// levelData matches the map itself inside a save: level.dat in old saves, level.dat0, level.dat1… in newer ones.
+var levelData = regexp.MustCompile(`^level\.dat\d*$`)
+
+// isSave reports whether a synced file is a save game.
+func isSave(rel string) bool {
+	return strings.HasPrefix(rel, "saves/") && strings.HasSuffix(rel, ".zip")
+}
+
+// checkSave checks a save is a whole zip with level data in it, going by its central directory alone. That's
+// at the end of the file, so a save that's still being written, or was cut short, fails.
+func checkSave(name string) error {
+	archive, err := zip.OpenReader(name)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrBadSave, name, err)
+	}
+	defer archive.Close()
+	return checkLevel(name, archive)
+}
+
+func checkLevel(name string, archive *zip.ReadCloser) error {
+	for _, entry := range archive.File {
+		if levelData.MatchString(path.Base(entry.Name)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s has no level data", ErrBadSave, name)
+}
+
+// validateSave is checkSave plus reading every entry so their CRCs are checked, which decompresses the
+// whole save, so it's only done at boot, on the save that's about to be loaded.
+func validateSave(name string) error {
+	archive, err := zip.OpenReader(name)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrBadSave, name, err)
+	}
+	defer archive.Close()
+	err = checkLevel(name, archive)
+	if err != nil {
+		return err
+	}
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		reader, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %s: %w", ErrBadSave, name, entry.Name, err)
+		}
+		_, err = io.Copy(io.Discard, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %s: %w", ErrBadSave, name, entry.Name, err)
+		}
+	}
+	return nil
+}
+
+// savesByAge lists the saves in dir, newest first.
+func savesByAge(dir string) ([]string, error) {
+	type save struct {
+		name    string
+		modTime int64
+	}
+	var saves []save
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".zip") {
+			saves = append(saves, save{path, info.ModTime().UnixNano()})
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	slices.SortFunc(saves, func(a, b save) int {
+		return int(b.modTime - a.modTime)
+	})
+	names := make([]string, len(saves))
+	for i, s := range saves {
+		names[i] = s.name
+	}
+	return names, nil
+}
+
+// newestValidSave is the newest save in dir that passes check, or "" if there's none.
+func newestValidSave(dir string, check func(string) error) (string, error) {
+	saves, err := savesByAge(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range saves {
+		err = check(name)
+		if err == nil {
+			return name, nil
+		}
+		slog.Warn("Skipping damaged save", "err", err)
+	}
+	return "", nil
+}
+
+// chooseSave keeps the sitter's save if it's sound, and otherwise falls back to the newest valid one.
+func (t *launcher) chooseSave() error {
+	err := validateSave(t.sitter.saveName)
+	if err == nil {
+		return nil
+	}
+	slog.Warn("Primary save failed validation, looking for a backup", "err", err)
+	backup, err := newestValidSave("saves", validateSave)
+	if err != nil {
+		return err
+	}
+	if backup == "" {
+		return fmt.Errorf("%w: no valid saves to fall back to", ErrBadSave)
+	}
+	slog.Warn("Falling back to backup save", "save", backup)
+	t.sitter.saveName = backup
+	return nil
+}
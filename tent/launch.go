@@ -2,6 +2,9 @@ package tent
 
 import (
 	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"mansionTent/share"
@@ -9,9 +12,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -21,15 +24,32 @@ import (
 
 type launcher struct {
 	sitter   *sitter
+	control  *control
 	s3       *s3.S3
 	s3folder url.URL
+	sync     *syncEngine
+	logs     *sessionLogs
 }
 
+var ErrGameDownload = errors.New("game download failed")
+
 func RunLauncher() {
-	NewLauncher().Run()
+	t, err := NewLauncher()
+	if err == nil {
+		err = t.Run(share.TraceContext())
+	}
+	if err != nil {
+		slog.Error("Launcher failed", "err", err)
+		if t != nil {
+			t.uploadLogs()
+			// whatever was sent before the failure would otherwise wait in the outbox until the next boot
+			t.sitter.hooks.flush()
+		}
+		panic(err)
+	}
 }
 
-func NewLauncher() *launcher {
+func NewLauncher() (*launcher, error) {
 	region := os.Getenv("AWS_REGION_S3")
 	if region == "" {
 		region = os.Getenv("AWS_REGION")
@@ -39,38 +59,75 @@ func NewLauncher() *launcher {
 		Config:            aws.Config{Region: aws.String(region)},
 	}))
 	t := &launcher{s3: s3.New(aws)}
+	logs, err := NewSessionLogs("logs", "factorio")
+	if err != nil {
+		return nil, err
+	}
+	t.logs = logs
+	t.logs.Capture()
 	t.sitter = NewSitter(NewHooks(t))
+	t.sitter.gameLog = t.logs.game
+	t.control = NewControl(t.sitter, t.logs)
 
 	parsed, err := url.Parse(os.Getenv("S3_FOLDER_URL"))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("parsing S3_FOLDER_URL: %w", err)
 	}
 	parsed.Path = strings.Trim(parsed.Path, "/")
 	t.s3folder = *parsed
 	t.s3folder.Path = strings.Trim(t.s3folder.Path, "/")
-	return t
+	t.sync = NewSyncEngine(t.s3, t.s3folder.Host, t.s3folder.Path, "factorio")
+	return t, nil
 }
 
-func (t *launcher) Run() {
+// Run boots the game and sits with it until it's done. The boot is traced as part of ctx,
+// which continues the tower's launch trace when it left a TRACEPARENT.
+func (t *launcher) Run(ctx context.Context) error {
 	slog.Info("Starting launcher")
+	go t.control.Run()
+	ctx, bootSpan := share.Tracer.Start(ctx, "tent boot")
+	t.sitter.setState(share.StateDownloading)
 	var waitGroup sync.WaitGroup
+	var gameErr, stateErr error
 	waitGroup.Add(2)
-	go t.downloadGame(&waitGroup)
-	go t.downloadState(&waitGroup)
+	go func() {
+		defer waitGroup.Done()
+		_, span := share.Tracer.Start(ctx, "download game")
+		gameErr = t.downloadGame()
+		share.EndSpan(span, gameErr)
+	}()
+	go func() {
+		defer waitGroup.Done()
+		_, span := share.Tracer.Start(ctx, "sync state")
+		stateErr = t.downloadState()
+		share.EndSpan(span, stateErr)
+	}()
 	waitGroup.Wait()
-	os.Chdir("factorio")
-	t.sitter.Run()
+	err := errors.Join(gameErr, stateErr)
+	if err == nil {
+		err = os.Chdir("factorio")
+	}
+	if err == nil {
+		err = t.chooseSave()
+	}
+	if err != nil {
+		share.EndSpan(bootSpan, err)
+		return err
+	}
+	t.sitter.setState(share.StateLaunching)
+	_, mapSpan := share.Tracer.Start(ctx, "load map")
+	t.sitter.onBooted = func() {
+		mapSpan.End()
+		bootSpan.End()
+	}
+	return t.sitter.Run()
 }
 
-func (t *launcher) downloadGame(wg *sync.WaitGroup) {
-	defer wg.Done()
+func (t *launcher) downloadGame() error {
 	// check if we need to do this
-	_, err := os.Stat("factorio/bin/x64/factorio")
-	if err == nil {
-		slog.Info("Game already downloaded")
-		return
-	} else if !os.IsNotExist(err) {
-		panic(err)
+	if binary := findGameBinary("factorio"); binary != "" {
+		slog.Info("Game already downloaded", "binary", binary)
+		return nil
 	}
 	// download
 	timer := share.NewPerfTimer()
@@ -78,30 +135,62 @@ func (t *launcher) downloadGame(wg *sync.WaitGroup) {
 	if version == "" {
 		version = "stable"
 	}
-	url := "https://www.factorio.com/get-download/" + version + "/headless/linux64"
-	slog.Info("Downloading game from", "url", url)
-	download, err := http.Get(url)
-	if err != nil {
-		panic(err)
+	platforms := gamePlatforms()
+	if len(platforms) == 0 {
+		return fmt.Errorf("%w: no game build for %s", ErrGameDownload, runtime.GOARCH)
+	}
+	var download *http.Response
+	for _, platform := range platforms {
+		url := "https://www.factorio.com/get-download/" + version + "/headless/" + platform
+		slog.Info("Downloading game from", "url", url)
+		var err error
+		download, err = http.Get(url)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrGameDownload, err)
+		}
+		if download.StatusCode == http.StatusOK {
+			break
+		}
+		download.Body.Close()
+		if download.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("%w: %s from %s", ErrGameDownload, download.Status, url)
+		}
+		slog.Info("No build for this platform", "platform", platform)
+	}
+	if download.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: no build of %s for %v", ErrGameDownload, version, platforms)
 	}
 	defer download.Body.Close()
-	decompress, err := xz.NewReader(download.Body, 0)
+	progress := &t.sitter.progress
+	progress.Set(taskGame, 0, max(download.ContentLength, 0), "bytes")
+	defer progress.Clear(taskGame)
+	body := &progressReader{Reader: download.Body, progress: progress, task: taskGame}
+	decompress, err := xz.NewReader(body, 0)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: %w", ErrGameDownload, err)
 	}
 	// we'll unpack everything as we download it
 	unpack := tar.NewReader(decompress)
-	for t.unpackOneFile(unpack) {
+	for {
+		more, err := t.unpackOneFile(unpack)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrGameDownload, err)
+		}
+		if !more {
+			break
+		}
 	}
+	metrics.Observe("tent_s3_download_seconds", timer.Elapsed().Seconds(), "kind", "game")
 	slog.Info("Downloaded game files", "elapsed", timer)
+	return nil
 }
 
-func (t *launcher) unpackOneFile(unpack *tar.Reader) bool {
+func (t *launcher) unpackOneFile(unpack *tar.Reader) (bool, error) {
 	header, err := unpack.Next()
 	if err == io.EOF {
-		return false // end of tar archive
+		return false, nil // end of tar archive
 	} else if err != nil {
-		panic(err)
+		return false, err
 	}
 	slog.Debug("Unpacking", "file", header.Name)
 	mode := header.FileInfo().Mode()
@@ -109,145 +198,93 @@ func (t *launcher) unpackOneFile(unpack *tar.Reader) bool {
 	case tar.TypeDir:
 		err := os.MkdirAll(header.Name, mode)
 		if err != nil {
-			panic(err)
+			return false, err
 		}
 	case tar.TypeReg:
 		err := os.MkdirAll(filepath.Dir(header.Name), mode|mode>>2&0o111)
 		if err != nil {
-			panic(err)
+			return false, err
 		}
 		file, err := os.OpenFile(header.Name, os.O_CREATE|os.O_WRONLY, mode)
 		if err != nil {
-			panic(err)
+			return false, err
 		}
 		defer file.Close()
 		_, err = io.Copy(file, unpack)
 		if err != nil {
-			panic(err)
+			return false, fmt.Errorf("unpacking %s: %w", header.Name, err)
 		}
 	}
-	return true // continue unpacking
+	return true, nil // continue unpacking
 }
 
-func (t *launcher) downloadState(wg *sync.WaitGroup) {
-	defer wg.Done()
-	// check if we need to do this
-	_, err := os.Stat("factorio/saves")
-	if err == nil {
-		slog.Info("State files already downloaded")
-		return
-	} else if !os.IsNotExist(err) {
-		panic(err)
-	}
-	// start downloaders
+func (t *launcher) downloadState() error {
 	timer := share.NewPerfTimer()
-	queue := make(chan *string, 5)
-	for i := 0; i < cap(queue); i++ {
-		go func() {
-			for key := range queue {
-				if key == nil {
-					return
-				}
-				t.downloadOneFile(key)
-			}
-		}()
-	}
-	// enumerate files from s3
-	slog.Info("Downloading save files from", "s3", t.s3folder.String())
-	request := &s3.ListObjectsInput{
-		Bucket: aws.String(t.s3folder.Host),
-		Prefix: aws.String(t.s3folder.Path + "/"),
-	}
-	for nextPage := aws.String("first"); nextPage != nil; nextPage = request.Marker {
-		response, err := t.s3.ListObjects(request)
-		if err != nil {
-			panic(err)
-		}
-		for _, object := range response.Contents {
-			// dunno if this can be nil, but if it ever happens there will be a deadlock
-			if object.Key != nil {
-				queue <- object.Key
-			}
-		}
-		request.Marker = response.NextMarker
-	}
-	// wait for downloaders to finish
-	for i := 0; i < cap(queue); i++ {
-		queue <- nil
-	}
-	slog.Info("Downloaded save and config/mod files", "elapsed", timer)
-}
-
-func (t *launcher) downloadOneFile(key *string) {
-	destPath := "factorio/" + strings.TrimPrefix(*key, t.s3folder.Path+"/")
-	slog.Debug("Downloading", "file", *key, "to", destPath)
-	// download the source file
-	response, err := t.s3.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(t.s3folder.Host),
-		Key:    key,
+	slog.Info("Syncing save and config/mod files from", "s3", t.s3folder.String())
+	progress := &t.sitter.progress
+	defer progress.Clear(taskState)
+	err := t.sync.Pull(func(done, total int) {
+		progress.Set(taskState, int64(done), int64(total), "files")
 	})
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer response.Body.Close()
-	// create the destination file
-	err = os.MkdirAll(filepath.Dir(destPath), 0o755)
-	if err != nil {
-		panic(err)
-	}
-	file, err := os.Create(destPath)
+	metrics.Observe("tent_s3_download_seconds", timer.Elapsed().Seconds(), "kind", "state")
+	slog.Info("Synced save and config/mod files", "elapsed", timer)
+	return nil
+}
+
+// uploadLogs sends the logs so far to S3, so they outlive the instance.
+func (t *launcher) uploadLogs() {
+	timer := share.NewPerfTimer()
+	err := t.logs.Upload(t.s3, t.s3folder.Host, t.s3folder.Path)
 	if err != nil {
-		panic(err)
+		slog.Error("Error uploading logs to S3", "err", err)
+		return
 	}
-	defer file.Close()
-	// copy the file
-	_, err = io.Copy(file, response.Body)
+	metrics.Observe("tent_s3_upload_seconds", timer.Elapsed().Seconds(), "kind", "logs")
+	slog.Info("Uploaded logs to S3", "session", t.logs.session, "elapsed", timer)
+}
+
+// uploadState sends config changes, new mods and the like back to S3 before the instance goes away.
+func (t *launcher) uploadState() {
+	timer := share.NewPerfTimer()
+	err := t.sync.Push()
 	if err != nil {
-		panic(err)
+		slog.Error("Error syncing state to S3", "err", err)
+		return
 	}
+	metrics.Observe("tent_s3_upload_seconds", timer.Elapsed().Seconds(), "kind", "state")
+	slog.Info("Synced state to S3", "elapsed", timer)
 }
 
-func (t *launcher) uploadSave() {
-	// get the most recent save
-	var mostRecent string
-	var mostRecentTime time.Time
-	filepath.Walk("saves", func(path string, info os.FileInfo, err error) error {
-		slog.Debug("Checking", "file", path)
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		if strings.HasSuffix(path, ".zip") {
-			modTime := info.ModTime()
-			if mostRecentTime.Before(modTime) {
-				mostRecentTime = info.ModTime()
-				mostRecent = path
-			}
-		}
-		return nil
-	})
+// uploadSave sends the newest save that passes checkSave to S3, skipping any that are half-written.
+// The result's Duration is left for the caller, who knows when the save started.
+func (t *launcher) uploadSave() share.SaveResult {
+	mostRecent, err := newestValidSave("saves", checkSave)
+	if err != nil {
+		slog.Error("Error looking for saves", "err", err)
+		return share.SaveResult{Error: err.Error()}
+	}
 	if mostRecent == "" {
-		slog.Warn("No save files found")
-		return
+		slog.Warn("No valid save files found")
+		return share.SaveResult{Error: "no valid save files found"}
 	}
 	// upload the save
 	timer := share.NewPerfTimer()
 	slog.Info("Uploading save", "file", mostRecent)
-	file, err := os.Open(mostRecent)
-	if err != nil {
-		slog.Error("Error opening file", "err", err)
-		return
-	}
-	defer file.Close()
-	_, err = t.s3.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(t.s3folder.Host),
-		Key:    aws.String(t.s3folder.Path + "/" + mostRecent),
-		Body:   file,
-	})
+	result := share.SaveResult{File: filepath.Base(mostRecent)}
+	err = t.sync.Upload(filepath.ToSlash(mostRecent))
 	if err != nil {
 		slog.Error("Error uploading file", "err", err)
+		result.Error = err.Error()
+		return result
+	}
+	metrics.Observe("tent_s3_upload_seconds", timer.Elapsed().Seconds(), "kind", "save")
+	if info, err := os.Stat(mostRecent); err == nil {
+		result.Size = info.Size()
+		metrics.Set("tent_save_size_bytes", float64(result.Size))
 	}
 	slog.Info("Uploaded save", "file", mostRecent, "elapsed", timer)
+	return result
 }
@@ -0,0 +1,295 @@
+package tent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// tailLines is how many recent lines each log keeps in memory for the control port.
+const tailLines = 200
+
+// rotatingLog appends to <dir>/<name>.log and gzips it to <name>.<n>.log.gz once it grows past limit.
+// Only the newest keep rotated files are kept around.
+type rotatingLog struct {
+	mutex    sync.Mutex
+	dir      string
+	name     string
+	limit    int64
+	keep     int
+	file     *os.File
+	size     int64
+	rotation int
+	tail     []string
+}
+
+func newRotatingLog(dir, name string) *rotatingLog {
+	return &rotatingLog{
+		dir:   dir,
+		name:  name,
+		limit: int64(parseIntOrDefault("LOG_ROTATE_MB", 10)) << 20,
+		keep:  parseIntOrDefault("LOG_KEEP_FILES", 10),
+	}
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		l.tail = append(l.tail, line)
+	}
+	if len(l.tail) > tailLines {
+		l.tail = slices.Clone(l.tail[len(l.tail)-tailLines:])
+	}
+	if l.file == nil {
+		var err error
+		l.file, err = os.OpenFile(filepath.Join(l.dir, l.name+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	if err == nil && l.size >= l.limit {
+		err = l.rotateLocked()
+	}
+	return n, err
+}
+
+// Tail returns the most recent lines.
+func (l *rotatingLog) Tail() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return slices.Clone(l.tail)
+}
+
+// Rotate compresses whatever has been written so far, so it can be uploaded.
+func (l *rotatingLog) Rotate() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rotateLocked()
+}
+
+func (l *rotatingLog) rotateLocked() error {
+	if l.file == nil {
+		return nil
+	}
+	l.file.Close()
+	l.file, l.size = nil, 0
+	current := filepath.Join(l.dir, l.name+".log")
+	l.rotation++
+	err := gzipFile(current, filepath.Join(l.dir, fmt.Sprintf("%s.%03d.log.gz", l.name, l.rotation)))
+	if err != nil {
+		return err
+	}
+	os.Remove(current)
+	// the rotation numbers are zero-padded, so the oldest sort first
+	rotated, _ := filepath.Glob(filepath.Join(l.dir, l.name+".*.log.gz"))
+	for len(rotated) > l.keep {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+func gzipFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	compress := gzip.NewWriter(out)
+	_, err = io.Copy(compress, in)
+	if err != nil {
+		return fmt.Errorf("compressing %s: %w", from, err)
+	}
+	return compress.Close()
+}
+
+// sessionLogs are the logs of one tent run, uploaded to <prefix>/logs/<session>/.
+type sessionLogs struct {
+	dir        string
+	session    string
+	game       *rotatingLog
+	tent       *rotatingLog
+	factorio   string // the game's own factorio-current.log
+	uploadLock sync.Mutex
+}
+
+func NewSessionLogs(dir, gameDir string) (*sessionLogs, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating log directory: %w", err)
+	}
+	gameDir, err = filepath.Abs(gameDir)
+	if err != nil {
+		return nil, err
+	}
+	err = setAsideLeftovers(dir)
+	if err != nil {
+		return nil, fmt.Errorf("setting aside earlier logs: %w", err)
+	}
+	return &sessionLogs{
+		dir:      dir,
+		session:  time.Now().UTC().Format("20060102-150405"),
+		game:     newRotatingLog(dir, "game"),
+		tent:     newRotatingLog(dir, "tent"),
+		factorio: filepath.Join(gameDir, "factorio-current.log"),
+	}, nil
+}
+
+// setAsideLeftovers moves whatever an earlier session didn't get to upload, e.g. because the instance died
+// or kept its data volume, into earlier/. It goes up with this session's logs but apart from them.
+func setAsideLeftovers(dir string) error {
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*.log*"))
+	if err != nil || len(leftovers) == 0 {
+		return err
+	}
+	earlier := filepath.Join(dir, "earlier")
+	err = os.MkdirAll(earlier, 0o755)
+	if err != nil {
+		return err
+	}
+	for _, name := range leftovers {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		// several earlier sessions may each have left a game.001.log.gz
+		target := filepath.Join(earlier, info.ModTime().UTC().Format("20060102-150405-")+filepath.Base(name))
+		if strings.HasSuffix(name, ".gz") {
+			err = os.Rename(name, target)
+		} else {
+			err = gzipFile(name, target+".gz")
+			if err == nil {
+				err = os.Remove(name)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	slog.Info("Set aside logs from an earlier session", "files", len(leftovers))
+	return nil
+}
+
+// Capture tees the tent's own logging into the tent log, at debug level whatever the console shows.
+func (l *sessionLogs) Capture() {
+	file := slog.NewTextHandler(l.tent, &slog.HandlerOptions{Level: slog.LevelDebug})
+	slog.SetDefault(slog.New(teeHandler{slog.Default().Handler(), file}))
+}
+
+// Tail is the recent output of the game and the tent, for a quick look without waiting for an upload.
+func (l *sessionLogs) Tail() string {
+	return "== game ==\n" + strings.Join(l.game.Tail(), "\n") +
+		"\n\n== tent ==\n" + strings.Join(l.tent.Tail(), "\n") + "\n"
+}
+
+// Upload rotates the logs and sends every compressed file to S3, deleting the ones that made it.
+func (l *sessionLogs) Upload(client *s3.S3, bucket, prefix string) error {
+	l.uploadLock.Lock()
+	defer l.uploadLock.Unlock()
+	err := l.game.Rotate()
+	if err != nil {
+		return err
+	}
+	err = l.tent.Rotate()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(l.factorio); err == nil {
+		err = gzipFile(l.factorio, filepath.Join(l.dir, "factorio-current.log.gz"))
+		if err != nil {
+			return err
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(l.dir, "*.gz"))
+	if err != nil {
+		return err
+	}
+	earlier, err := filepath.Glob(filepath.Join(l.dir, "earlier", "*.gz"))
+	if err != nil {
+		return err
+	}
+	for _, name := range append(files, earlier...) {
+		rel, err := filepath.Rel(l.dir, name)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimPrefix(prefix+"/logs/"+l.session+"/"+filepath.ToSlash(rel), "/")
+		err = uploadLog(client, bucket, key, name)
+		if err != nil {
+			return err
+		}
+		os.Remove(name)
+	}
+	return nil
+}
+
+func uploadLog(client *s3.S3, bucket, key, name string) error {
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(contents),
+		// served decompressed, so a presigned link opens right in the browser
+		ContentType:     aws.String("text/plain; charset=utf-8"),
+		ContentEncoding: aws.String("gzip"),
+	})
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+	return nil
+}
+
+// teeHandler sends every record to both handlers.
+type teeHandler [2]slog.Handler
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h[0].Enabled(ctx, level) || h[1].Enabled(ctx, level)
+}
+
+func (h teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs [2]error
+	for i, handler := range h {
+		if handler.Enabled(ctx, r.Level) {
+			errs[i] = handler.Handle(ctx, r.Clone())
+		}
+	}
+	if errs[0] != nil {
+		return errs[0]
+	}
+	return errs[1]
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return teeHandler{h[0].WithAttrs(attrs), h[1].WithAttrs(attrs)}
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	return teeHandler{h[0].WithGroup(name), h[1].WithGroup(name)}
+}
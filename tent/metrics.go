@@ -0,0 +1,78 @@
+package tent
+
+import (
+	"fmt"
+	"log/slog"
+	"mansionTent/share"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var metrics = share.NewMetrics()
+
+func init() {
+	metrics.Describe("factorio_game_tick", share.Gauge, "The game's tick, as last sampled over RCON.")
+	metrics.Describe("factorio_ups", share.Gauge, "Game updates per second between the last two samples; 60 is full speed.")
+	metrics.Describe("factorio_ups_window", share.Gauge, "Game updates per second over the UPS_WINDOW_MINUTES rolling window.")
+	metrics.Describe("factorio_entities", share.Gauge, "Entities on all surfaces, counted once per window.")
+	metrics.Describe("tent_game_restarts_total", share.Counter, "Times the game exited without being told to and was started again.")
+	metrics.Describe("tent_save_duration_seconds", share.Histogram, "Time the game spent writing saves.")
+	metrics.Describe("tent_save_size_bytes", share.Gauge, "Size of the last uploaded save.")
+	metrics.Describe("tent_s3_upload_seconds", share.Histogram, "Time spent uploading to S3, by what was uploaded.")
+	metrics.Describe("tent_s3_download_seconds", share.Histogram, "Time spent downloading at boot, by what was downloaded.")
+}
+
+// clockTicks is USER_HZ, which is 100 on every Linux the tent runs on.
+const clockTicks = 100
+
+// processStats reads the CPU time and resident memory of a process from /proc.
+func processStats(pid int) (cpuSeconds, rssBytes float64, err error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// the command name can contain spaces, so count fields from after it; the first one there is field 3
+	end := strings.LastIndexByte(string(stat), ')')
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("short /proc/%d/stat", pid)
+	}
+	utime, _ := strconv.ParseFloat(fields[11], 64)
+	stime, _ := strconv.ParseFloat(fields[12], 64)
+	rss, _ := strconv.ParseFloat(fields[21], 64)
+	return (utime + stime) / clockTicks, rss * float64(os.Getpagesize()), nil
+}
+
+// observeMetrics declares the metrics that are only read when scraped.
+func (s *sitter) observeMetrics() {
+	metrics.DescribeObserved("factorio_players_online", share.Gauge, "Players in the game.", func(observe share.Observer) {
+		observe(float64(len(s.Status().Players)))
+	})
+	metrics.DescribeObserved("process_resident_memory_bytes", share.Gauge, "Resident memory of the tent and the game.", func(observe share.Observer) {
+		s.observeProcesses(func(_, rss float64, process string) {
+			observe(rss, "process", process)
+		})
+	})
+	metrics.DescribeObserved("process_cpu_seconds_total", share.Counter, "CPU time used by the tent and the game.", func(observe share.Observer) {
+		s.observeProcesses(func(cpu, _ float64, process string) {
+			observe(cpu, "process", process)
+		})
+	})
+}
+
+// observeProcesses reads the stats of the tent and, if it's running, the game.
+func (s *sitter) observeProcesses(observe func(cpuSeconds, rssBytes float64, process string)) {
+	pids := map[string]int{"tent": os.Getpid()}
+	if pid := s.gamePid(); pid != 0 {
+		pids["game"] = pid
+	}
+	for process, pid := range pids {
+		cpu, rss, err := processStats(pid)
+		if err != nil {
+			slog.Debug("Error reading process stats", "process", process, "err", err)
+			continue
+		}
+		observe(cpu, rss, process)
+	}
+}
@@ -0,0 +1,324 @@
+package tent
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// S3 won't take parts smaller than this, except the last one
+	minPartSize = 5 << 20
+	// tries for each part or small file before giving up on it
+	transferAttempts = 4
+	// multipart uploads this old are from a tent that died and aren't worth resuming
+	abandonedAfter = 24 * time.Hour
+)
+
+// byteRange is one part of a file.
+type byteRange struct {
+	offset, length int64
+}
+
+// parts splits size bytes into part-sized ranges.
+func (e *syncEngine) parts(size int64) []byteRange {
+	var ranges []byteRange
+	for offset := int64(0); offset < size; offset += e.partSize {
+		ranges = append(ranges, byteRange{offset, min(e.partSize, size-offset)})
+	}
+	return ranges
+}
+
+// inParallel runs fn for 0…count-1 on a few workers and returns the first error.
+func inParallel(workers, count int, fn func(int) error) error {
+	queue := make(chan int)
+	errs := make(chan error, count)
+	var waitGroup sync.WaitGroup
+	for i := 0; i < min(workers, count); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for n := range queue {
+				errs <- fn(n)
+			}
+		}()
+	}
+	for n := 0; n < count; n++ {
+		queue <- n
+	}
+	close(queue)
+	waitGroup.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry runs fn until it works, backing off between tries, so a dropped connection doesn't lose a whole save.
+func retry(what string, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= transferAttempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if attempt < transferAttempts {
+			delay := time.Duration(1<<(attempt-1)) * time.Second
+			slog.Warn("Retrying", "what", what, "attempt", attempt, "in", delay, "err", err)
+			time.Sleep(delay)
+		}
+	}
+	return err
+}
+
+func sectionMD5(file *os.File, part byteRange) ([]byte, error) {
+	hash := md5.New()
+	_, err := io.Copy(hash, io.NewSectionReader(file, part.offset, part.length))
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// abandoned reports whether an upload is too old to be worth resuming.
+func abandoned(upload *s3.MultipartUpload, now time.Time) bool {
+	return now.Sub(aws.TimeValue(upload.Initiated)) > abandonedAfter
+}
+
+// newestResumable picks the newest upload of key worth resuming. Only uploads left by an earlier tent count;
+// this one's own failed uploads are as stale as the file they were sending.
+func (e *syncEngine) newestResumable(uploads []*s3.MultipartUpload, key string, now time.Time) *s3.MultipartUpload {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var newest *s3.MultipartUpload
+	for _, candidate := range uploads {
+		if aws.StringValue(candidate.Key) != key || abandoned(candidate, now) || e.started[aws.StringValue(candidate.UploadId)] {
+			continue
+		}
+		if newest == nil || aws.TimeValue(candidate.Initiated).After(aws.TimeValue(newest.Initiated)) {
+			newest = candidate
+		}
+	}
+	return newest
+}
+
+// resumableUpload finds an unfinished multipart upload of key, and the parts it already has.
+func (e *syncEngine) resumableUpload(key string) (string, map[int64]*s3.Part, error) {
+	var uploads []*s3.MultipartUpload
+	err := e.s3.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(e.bucket),
+		Prefix: aws.String(key),
+	}, func(page *s3.ListMultipartUploadsOutput, _ bool) bool {
+		uploads = append(uploads, page.Uploads...)
+		return true
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	upload := e.newestResumable(uploads, key, time.Now())
+	if upload == nil {
+		return "", nil, nil
+	}
+	uploaded := make(map[int64]*s3.Part)
+	err = e.s3.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(e.bucket),
+		Key:      aws.String(key),
+		UploadId: upload.UploadId,
+	}, func(page *s3.ListPartsOutput, _ bool) bool {
+		for _, part := range page.Parts {
+			uploaded[aws.Int64Value(part.PartNumber)] = part
+		}
+		return true
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return aws.StringValue(upload.UploadId), uploaded, nil
+}
+
+// uploadMultipart sends a big file in parts, SYNC_CONCURRENCY at a time. If an earlier tent was interrupted
+// uploading it, that upload is picked up again and the parts that still match the file aren't sent twice.
+// A failed upload is left in place to be resumed, until AbortAbandonedUploads clears it out.
+func (e *syncEngine) uploadMultipart(rel string, file *os.File, size int64) (string, error) {
+	key := e.prefix + rel
+	uploadID, uploaded, err := e.resumableUpload(key)
+	if err != nil {
+		return "", fmt.Errorf("looking for an upload of %s to resume: %w", rel, err)
+	}
+	if uploadID == "" {
+		created, err := e.s3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket: aws.String(e.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return "", fmt.Errorf("starting upload of %s: %w", rel, err)
+		}
+		uploadID = aws.StringValue(created.UploadId)
+		e.mutex.Lock()
+		e.started[uploadID] = true
+		e.mutex.Unlock()
+	} else {
+		slog.Info("Resuming upload", "file", rel, "parts", len(uploaded))
+	}
+	ranges := e.parts(size)
+	completed := make([]*s3.CompletedPart, len(ranges))
+	err = inParallel(e.concurrency, len(ranges), func(i int) error {
+		number := int64(i + 1)
+		sum, err := sectionMD5(file, ranges[i])
+		if err != nil {
+			return err
+		}
+		etag := hex.EncodeToString(sum)
+		if part, ok := uploaded[number]; ok && cleanETag(part.ETag) == etag && aws.Int64Value(part.Size) == ranges[i].length {
+			completed[i] = &s3.CompletedPart{PartNumber: aws.Int64(number), ETag: part.ETag}
+			return nil
+		}
+		return retry(fmt.Sprintf("%s part %d", rel, number), func() error {
+			response, err := e.s3.UploadPart(&s3.UploadPartInput{
+				Bucket:     aws.String(e.bucket),
+				Key:        aws.String(key),
+				UploadId:   aws.String(uploadID),
+				PartNumber: aws.Int64(number),
+				Body:       io.NewSectionReader(file, ranges[i].offset, ranges[i].length),
+				ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum)),
+			})
+			if err != nil {
+				return err
+			}
+			completed[i] = &s3.CompletedPart{PartNumber: aws.Int64(number), ETag: response.ETag}
+			return nil
+		})
+	})
+	if err != nil {
+		return "", fmt.Errorf("uploading %s: %w", rel, err)
+	}
+	// parts left over from a longer version of the file just aren't listed, and S3 drops them
+	response, err := e.s3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(e.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return "", fmt.Errorf("finishing upload of %s: %w", rel, err)
+	}
+	return cleanETag(response.ETag), nil
+}
+
+// AbortAbandonedUploads throws away multipart uploads under the prefix that were started over a day ago,
+// since S3 keeps charging for their parts until someone does.
+func (e *syncEngine) AbortAbandonedUploads() error {
+	var stale []*s3.MultipartUpload
+	err := e.s3.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(e.bucket),
+		Prefix: aws.String(e.prefix),
+	}, func(page *s3.ListMultipartUploadsOutput, _ bool) bool {
+		for _, upload := range page.Uploads {
+			if abandoned(upload, time.Now()) {
+				stale = append(stale, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("listing multipart uploads: %w", err)
+	}
+	for _, upload := range stale {
+		slog.Info("Aborting abandoned upload", "key", *upload.Key, "started", aws.TimeValue(upload.Initiated))
+		_, err = e.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(e.bucket),
+			Key:      upload.Key,
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			return fmt.Errorf("aborting upload of %s: %w", *upload.Key, err)
+		}
+	}
+	return nil
+}
+
+// downloadRanges fetches a big object in part-sized ranges, SYNC_CONCURRENCY at a time, into file.
+// Every range asks for the ETag from the listing, so an object replaced halfway through fails instead of mixing.
+func (e *syncEngine) downloadRanges(rel string, object *s3.Object, file *os.File) (string, int64, error) {
+	size := aws.Int64Value(object.Size)
+	err := file.Truncate(size)
+	if err != nil {
+		return "", 0, err
+	}
+	ranges := e.parts(size)
+	err = inParallel(e.concurrency, len(ranges), func(i int) error {
+		part := ranges[i]
+		return retry(fmt.Sprintf("%s bytes %d-", rel, part.offset), func() error {
+			response, err := e.s3.GetObject(&s3.GetObjectInput{
+				Bucket:  aws.String(e.bucket),
+				Key:     object.Key,
+				Range:   aws.String(fmt.Sprintf("bytes=%d-%d", part.offset, part.offset+part.length-1)),
+				IfMatch: object.ETag,
+			})
+			if err != nil {
+				return err
+			}
+			defer response.Body.Close()
+			written, err := io.Copy(io.NewOffsetWriter(file, part.offset), response.Body)
+			if err != nil {
+				return err
+			}
+			if written != part.length {
+				return fmt.Errorf("got %d of %d bytes", written, part.length)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("downloading %s: %w", rel, err)
+	}
+	return cleanETag(object.ETag), size, nil
+}
+
+// downloadWhole fetches a small object in one go into file.
+func (e *syncEngine) downloadWhole(rel string, object *s3.Object, file *os.File) (string, int64, error) {
+	var etag string
+	var size int64
+	err := retry(rel, func() error {
+		response, err := e.s3.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(e.bucket),
+			Key:    object.Key,
+		})
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		_, err = file.Seek(0, io.SeekStart)
+		if err == nil {
+			err = file.Truncate(0)
+		}
+		if err != nil {
+			return err
+		}
+		size, err = io.Copy(file, response.Body)
+		if err != nil {
+			return err
+		}
+		if response.ContentLength != nil && size != *response.ContentLength {
+			return fmt.Errorf("got %d of %d bytes", size, *response.ContentLength)
+		}
+		etag = cleanETag(response.ETag)
+		return nil
+	})
+	if err != nil {
+		return "", 0, fmt.Errorf("downloading %s: %w", rel, err)
+	}
+	return etag, size, nil
+}
@@ -0,0 +1,78 @@
+package tent
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestParts(t *testing.T) {
+	e := &syncEngine{partSize: minPartSize}
+	cases := []struct {
+		size int64
+		want []byteRange
+	}{
+		{0, nil},
+		{1, []byteRange{{0, 1}}},
+		{minPartSize, []byteRange{{0, minPartSize}}},
+		{minPartSize + 1, []byteRange{{0, minPartSize}, {minPartSize, 1}}},
+		{3*minPartSize - 10, []byteRange{{0, minPartSize}, {minPartSize, minPartSize}, {2 * minPartSize, minPartSize - 10}}},
+	}
+	for _, c := range cases {
+		got := e.parts(c.size)
+		if !slices.Equal(got, c.want) {
+			t.Errorf("parts(%d) = %v, want %v", c.size, got, c.want)
+		}
+		var total int64
+		for _, part := range got {
+			total += part.length
+		}
+		if total != c.size {
+			t.Errorf("parts(%d) covers %d bytes", c.size, total)
+		}
+	}
+}
+
+func TestNewestResumable(t *testing.T) {
+	now := time.Now()
+	upload := func(id, key string, age time.Duration) *s3.MultipartUpload {
+		return &s3.MultipartUpload{UploadId: aws.String(id), Key: aws.String(key), Initiated: aws.Time(now.Add(-age))}
+	}
+	cases := []struct {
+		name    string
+		uploads []*s3.MultipartUpload
+		started []string
+		want    string // "" means nothing to resume
+	}{
+		{"none", nil, nil, ""},
+		{"one", []*s3.MultipartUpload{upload("a", "p/saves/world.zip", time.Hour)}, nil, "a"},
+		{"newest wins", []*s3.MultipartUpload{
+			upload("old", "p/saves/world.zip", 3*time.Hour),
+			upload("new", "p/saves/world.zip", time.Hour),
+			upload("mid", "p/saves/world.zip", 2*time.Hour),
+		}, nil, "new"},
+		{"other key sharing the prefix", []*s3.MultipartUpload{upload("a", "p/saves/world.zip.bak", time.Hour)}, nil, ""},
+		{"abandoned", []*s3.MultipartUpload{upload("a", "p/saves/world.zip", abandonedAfter+time.Minute)}, nil, ""},
+		{"own upload", []*s3.MultipartUpload{upload("mine", "p/saves/world.zip", time.Minute)}, []string{"mine"}, ""},
+		{"earlier tent's behind own", []*s3.MultipartUpload{
+			upload("mine", "p/saves/world.zip", time.Minute),
+			upload("theirs", "p/saves/world.zip", time.Hour),
+		}, []string{"mine"}, "theirs"},
+	}
+	for _, c := range cases {
+		e := &syncEngine{started: make(map[string]bool)}
+		for _, id := range c.started {
+			e.started[id] = true
+		}
+		var got string
+		if upload := e.newestResumable(c.uploads, "p/saves/world.zip", now); upload != nil {
+			got = aws.StringValue(upload.UploadId)
+		}
+		if got != c.want {
+			t.Errorf("%s: newestResumable = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
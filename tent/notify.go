@@ -0,0 +1,205 @@
+package tent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// notifier posts a batch of events to one destination.
+// Notify follows the classifyResponse contract for retryAfter.
+type notifier interface {
+	Name() string
+	MaxBatch() int
+	Notify(batch []event) (retryAfter time.Duration, err error)
+}
+
+var notifyClient = &http.Client{Timeout: 15 * time.Second}
+
+// NewDeliveries starts a delivery for each sink that has been configured.
+// Every sink takes an optional <PREFIX>_EVENTS list to only receive some kinds of events.
+func NewDeliveries() []*delivery {
+	var deliveries []*delivery
+	add := func(n notifier, eventsKey string) {
+		deliveries = append(deliveries, NewDelivery(n, parseEventKinds(eventsKey)))
+	}
+	if url := os.Getenv("WEBHOOK_URL"); url != "" {
+		add(&discordNotifier{url: url}, "WEBHOOK_EVENTS")
+	}
+	if url := os.Getenv("SLACK_WEBHOOK_URL"); url != "" {
+		add(&slackNotifier{url: url}, "SLACK_EVENTS")
+	}
+	if homeserver := os.Getenv("MATRIX_HOMESERVER"); homeserver != "" {
+		add(&matrixNotifier{
+			homeserver: strings.TrimSuffix(homeserver, "/"),
+			room:       os.Getenv("MATRIX_ROOM_ID"),
+			token:      os.Getenv("MATRIX_ACCESS_TOKEN"),
+		}, "MATRIX_EVENTS")
+	}
+	if url := os.Getenv("NTFY_TOPIC_URL"); url != "" {
+		add(&ntfyNotifier{url: url, token: os.Getenv("NTFY_TOKEN")}, "NTFY_EVENTS")
+	}
+	if url := os.Getenv("JSON_WEBHOOK_URL"); url != "" {
+		add(&jsonNotifier{url: url, secret: os.Getenv("JSON_WEBHOOK_SECRET")}, "JSON_WEBHOOK_EVENTS")
+	}
+	return deliveries
+}
+
+func post(request *http.Request) (time.Duration, error) {
+	response, err := notifyClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	return classifyResponse(response)
+}
+
+func postJSON(method, url string, payload any, headers map[string]string) (time.Duration, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return -1, err
+	}
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	return post(request)
+}
+
+func joinText(batch []event) string {
+	lines := make([]string, len(batch))
+	for i, e := range batch {
+		lines[i] = e.Text
+	}
+	return strings.Join(lines, "\n")
+}
+
+// discordNotifier posts embeds to a Discord webhook.
+type discordNotifier struct {
+	url string
+}
+
+func (n *discordNotifier) Name() string { return "discord" }
+
+// Discord rejects messages with more embeds than this.
+func (n *discordNotifier) MaxBatch() int { return 10 }
+
+func (n *discordNotifier) Notify(batch []event) (time.Duration, error) {
+	embeds := make([]*discordgo.MessageEmbed, len(batch))
+	for i, e := range batch {
+		embeds[i] = discordEmbed(e)
+	}
+	return postJSON(http.MethodPost, n.url, map[string]any{"embeds": embeds}, nil)
+}
+
+func discordEmbed(e event) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title:     e.Text,
+		Color:     eventColor(e.Kind),
+		Timestamp: e.Time.Format(time.RFC3339),
+	}
+	if e.Address != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Address", Value: "`" + e.Address + "`", Inline: true})
+	}
+	if e.Version != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Version", Value: e.Version, Inline: true})
+	}
+	embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Players", Value: fmt.Sprint(e.Players), Inline: true})
+	return embed
+}
+
+// slackNotifier posts plain text to a Slack incoming webhook.
+type slackNotifier struct {
+	url string
+}
+
+func (n *slackNotifier) Name() string  { return "slack" }
+func (n *slackNotifier) MaxBatch() int { return 20 }
+
+func (n *slackNotifier) Notify(batch []event) (time.Duration, error) {
+	return postJSON(http.MethodPost, n.url, map[string]string{"text": joinText(batch)}, nil)
+}
+
+// matrixNotifier sends m.notice messages to a room through the client-server API.
+type matrixNotifier struct {
+	homeserver string
+	room       string
+	token      string
+}
+
+func (n *matrixNotifier) Name() string  { return "matrix" }
+func (n *matrixNotifier) MaxBatch() int { return 20 }
+
+func (n *matrixNotifier) Notify(batch []event) (time.Duration, error) {
+	// the transaction ID makes retries idempotent, so derive it from the batch itself
+	first := batch[0]
+	txn := fmt.Sprintf("mt-%d-%d", first.Time.UnixNano(), len(batch))
+	endpoint := n.homeserver + "/_matrix/client/v3/rooms/" + url.PathEscape(n.room) +
+		"/send/m.room.message/" + txn
+	payload := map[string]string{"msgtype": "m.notice", "body": joinText(batch)}
+	return postJSON(http.MethodPut, endpoint, payload, map[string]string{"Authorization": "Bearer " + n.token})
+}
+
+// ntfyNotifier publishes to an ntfy topic, which shows up as a phone push.
+type ntfyNotifier struct {
+	url   string
+	token string
+}
+
+func (n *ntfyNotifier) Name() string  { return "ntfy" }
+func (n *ntfyNotifier) MaxBatch() int { return 20 }
+
+func (n *ntfyNotifier) Notify(batch []event) (time.Duration, error) {
+	request, err := http.NewRequest(http.MethodPost, n.url, strings.NewReader(joinText(batch)))
+	if err != nil {
+		return -1, err
+	}
+	request.Header.Set("Title", "Factorio")
+	request.Header.Set("Tags", string(batch[len(batch)-1].Kind))
+	if n.token != "" {
+		request.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	return post(request)
+}
+
+// jsonNotifier posts the raw events to any URL, signed with an HMAC of the body
+// so the receiver can tell the request came from us.
+type jsonNotifier struct {
+	url    string
+	secret string
+}
+
+func (n *jsonNotifier) Name() string  { return "json" }
+func (n *jsonNotifier) MaxBatch() int { return 50 }
+
+func (n *jsonNotifier) Notify(batch []event) (time.Duration, error) {
+	body, err := json.Marshal(map[string]any{"events": batch})
+	if err != nil {
+		return -1, err
+	}
+	request, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		request.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return post(request)
+}
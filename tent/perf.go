@@ -0,0 +1,155 @@
+package tent
+
+import (
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tickSample is the game tick at one moment.
+type tickSample struct {
+	at   time.Time
+	tick int64
+}
+
+// upsWindow keeps the tick samples of the last window. A blocking autosave stalls the game for a few
+// intervals, which is enough to drag the window's average under the threshold on a healthy map, so
+// slowness goes by how many of the intervals were slow rather than by the average.
+type upsWindow struct {
+	length  time.Duration
+	samples []tickSample
+}
+
+// Add records a sample and returns the update rate over the window, the share of the intervals in it that
+// ran under threshold, and whether the samples cover most of the window yet.
+func (w *upsWindow) Add(sample tickSample, threshold float64) (ups, slow float64, full bool) {
+	if n := len(w.samples); n > 0 && sample.tick < w.samples[n-1].tick {
+		// the game restarted
+		w.Reset()
+	}
+	w.samples = append(w.samples, sample)
+	cutoff := sample.at.Add(-w.length)
+	for len(w.samples) > 2 && w.samples[1].at.Before(cutoff) {
+		w.samples = w.samples[1:]
+	}
+	first := w.samples[0]
+	elapsed := sample.at.Sub(first.at)
+	if elapsed <= 0 {
+		return 0, 0, false
+	}
+	slowIntervals := 0
+	for i := 1; i < len(w.samples); i++ {
+		previous, next := w.samples[i-1], w.samples[i]
+		if float64(next.tick-previous.tick)/next.at.Sub(previous.at).Seconds() < threshold {
+			slowIntervals++
+		}
+	}
+	ups = float64(sample.tick-first.tick) / elapsed.Seconds()
+	slow = float64(slowIntervals) / float64(len(w.samples)-1)
+	return ups, slow, elapsed >= w.length*9/10
+}
+
+func (w *upsWindow) Reset() {
+	w.samples = nil
+}
+
+// instanceSizes are EC2 sizes from small to big. Factorio mostly runs on one core, so a bigger size helps
+// through the newer hardware, bigger caches and memory bandwidth that come with it, not the extra cores.
+var instanceSizes = []string{"nano", "micro", "small", "medium", "large", "xlarge",
+	"2xlarge", "4xlarge", "8xlarge", "12xlarge", "16xlarge", "24xlarge", "32xlarge", "48xlarge"}
+
+// biggerInstanceType suggests the next size up in the same family, e.g. c7a.xlarge for c7a.large.
+func biggerInstanceType(current string) string {
+	family, size, ok := strings.Cut(current, ".")
+	if !ok {
+		return ""
+	}
+	i := slices.Index(instanceSizes, size)
+	if i < 0 || i+1 == len(instanceSizes) {
+		return ""
+	}
+	return family + "." + instanceSizes[i+1]
+}
+
+// monitorPerformance reads the game tick over RCON every UPS_SAMPLE_SECONDS to work out the update rate,
+// and sends a degraded webhook when it's under UPS_ALERT_THRESHOLD for most of a UPS_WINDOW_MINUTES window.
+// It's off by default, because it takes a Lua command, which disables achievements for the save.
+func (s *sitter) monitorPerformance() {
+	interval := parseFloatDurationOrDefault("UPS_SAMPLE_SECONDS", 0, time.Second)
+	if interval <= 0 {
+		return
+	}
+	window := &upsWindow{length: parseFloatToMinutesOrDefault("UPS_WINDOW_MINUTES", 5)}
+	threshold := float64(parseIntOrDefault("UPS_ALERT_THRESHOLD", 55))
+	suggestion := biggerInstanceType(os.Getenv("EC2_INSTANCE_TYPE"))
+	var last tickSample
+	var lastCount time.Time
+	var entities int
+	alerted := false
+	for range time.Tick(interval) {
+		// an empty server is paused, which isn't slow
+		if !s.running() || len(s.Status().Players) == 0 {
+			window.Reset()
+			last = tickSample{}
+			continue
+		}
+		sample, err := s.sampleTick()
+		if err != nil {
+			slog.Debug("Error sampling game tick", "err", err)
+			window.Reset()
+			last = tickSample{}
+			continue
+		}
+		metrics.Set("factorio_game_tick", float64(sample.tick))
+		if !last.at.IsZero() && sample.tick >= last.tick {
+			metrics.Set("factorio_ups", float64(sample.tick-last.tick)/sample.at.Sub(last.at).Seconds())
+		}
+		last = sample
+		// counting entities walks every surface, so it's only done once per window
+		if time.Since(lastCount) >= window.length {
+			lastCount = time.Now()
+			entities, err = s.countEntities()
+			if err != nil {
+				slog.Debug("Error counting entities", "err", err)
+			} else {
+				metrics.Set("factorio_entities", float64(entities))
+			}
+		}
+		ups, slow, full := window.Add(sample, threshold)
+		if !full {
+			continue
+		}
+		metrics.Set("factorio_ups_window", ups)
+		if slow <= 0.5 {
+			alerted = false
+		} else if !alerted {
+			alerted = true
+			slog.Warn("Game is running slow", "ups", ups, "slow", slow, "threshold", threshold, "entities", entities)
+			s.hooks.onDegraded(ups, entities, suggestion)
+		}
+	}
+}
+
+func (s *sitter) sampleTick() (tickSample, error) {
+	reply, err := s.rcon.Command("/silent-command rcon.print(game.tick)")
+	if err != nil {
+		return tickSample{}, err
+	}
+	tick, err := strconv.ParseInt(strings.TrimSpace(reply), 10, 64)
+	if err != nil {
+		return tickSample{}, err
+	}
+	return tickSample{at: time.Now(), tick: tick}, nil
+}
+
+func (s *sitter) countEntities() (int, error) {
+	reply, err := s.rcon.Command("/silent-command local n = 0 for _, surface in pairs(game.surfaces) do " +
+		"n = n + surface.count_entities_filtered{} end rcon.print(n)")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(reply))
+}
@@ -0,0 +1,91 @@
+package tent
+
+import (
+	"testing"
+	"time"
+)
+
+// feed adds samples every interval at the given update rates, starting from a fresh window.
+func feed(window *upsWindow, interval time.Duration, rates []float64, threshold float64) (ups, slow float64, full bool) {
+	window.Reset()
+	at := time.Unix(0, 0)
+	tick := int64(0)
+	ups, slow, full = window.Add(tickSample{at, tick}, threshold)
+	for _, rate := range rates {
+		at = at.Add(interval)
+		tick += int64(rate * interval.Seconds())
+		ups, slow, full = window.Add(tickSample{at, tick}, threshold)
+	}
+	return ups, slow, full
+}
+
+func repeat(rate float64, n int) []float64 {
+	rates := make([]float64, n)
+	for i := range rates {
+		rates[i] = rate
+	}
+	return rates
+}
+
+func TestUpsWindow(t *testing.T) {
+	const threshold = 55
+	interval := 10 * time.Second
+	// a blocking autosave stalls the game for about 30s of a 5 minute window
+	autosave := append(append(repeat(60, 13), 0, 0, 0), repeat(60, 14)...)
+	cases := []struct {
+		name      string
+		rates     []float64
+		wantSlow  bool
+		wantFull  bool
+		wantBelow bool // whether the window's average is under the threshold
+	}{
+		{"healthy", repeat(60, 30), false, true, false},
+		{"autosave", autosave, false, true, true},
+		{"degraded", repeat(40, 30), true, true, true},
+		{"slow for just under half", append(repeat(60, 15), repeat(40, 15)...), false, true, true},
+		{"slow for just over half", append(repeat(60, 14), repeat(40, 16)...), true, true, true},
+		{"too soon to tell", repeat(40, 10), true, false, true},
+	}
+	for _, c := range cases {
+		window := &upsWindow{length: 5 * time.Minute}
+		ups, slow, full := feed(window, interval, c.rates, threshold)
+		if full != c.wantFull {
+			t.Errorf("%s: full = %v, want %v", c.name, full, c.wantFull)
+		}
+		if (slow > 0.5) != c.wantSlow {
+			t.Errorf("%s: slow share = %.2f, want slow %v", c.name, slow, c.wantSlow)
+		}
+		if (ups < threshold) != c.wantBelow {
+			t.Errorf("%s: ups = %.1f, want under %d %v", c.name, ups, threshold, c.wantBelow)
+		}
+	}
+}
+
+func TestUpsWindowResetsWhenTheGameRestarts(t *testing.T) {
+	window := &upsWindow{length: time.Minute}
+	start := time.Unix(0, 0)
+	window.Add(tickSample{start, 100000}, 55)
+	window.Add(tickSample{start.Add(10 * time.Second), 100600}, 55)
+	_, slow, full := window.Add(tickSample{start.Add(20 * time.Second), 10}, 55)
+	if full || slow != 0 || len(window.samples) != 1 {
+		t.Errorf("after a restart: full %v, slow %.2f, %d samples; want a fresh window", full, slow, len(window.samples))
+	}
+}
+
+func TestBiggerInstanceType(t *testing.T) {
+	cases := map[string]string{
+		"c7a.large":    "c7a.xlarge",
+		"c7g.xlarge":   "c7g.2xlarge",
+		"t3.nano":      "t3.micro",
+		"m7i.32xlarge": "m7i.48xlarge",
+		"m7i.48xlarge": "", // top of the ladder
+		"c7a.metal":    "",
+		"c7a":          "",
+		"":             "",
+	}
+	for current, want := range cases {
+		if got := biggerInstanceType(current); got != want {
+			t.Errorf("biggerInstanceType(%q) = %q, want %q", current, got, want)
+		}
+	}
+}
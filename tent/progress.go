@@ -0,0 +1,71 @@
+package tent
+
+import (
+	"io"
+	"mansionTent/share"
+	"sync"
+)
+
+const (
+	taskGame  = "downloading game"
+	taskState = "syncing state"
+	taskMap   = "loading map"
+)
+
+// progress keeps track of the boot tasks in flight, in the order they started.
+type progress struct {
+	mutex sync.Mutex
+	tasks []share.Progress
+}
+
+func (p *progress) Set(task string, done, total int64, unit string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := range p.tasks {
+		if p.tasks[i].Task == task {
+			p.tasks[i].Done, p.tasks[i].Total = done, total
+			return
+		}
+	}
+	p.tasks = append(p.tasks, share.Progress{Task: task, Done: done, Total: total, Unit: unit})
+}
+
+func (p *progress) Add(task string, delta int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := range p.tasks {
+		if p.tasks[i].Task == task {
+			p.tasks[i].Done += delta
+		}
+	}
+}
+
+func (p *progress) Clear(task string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := range p.tasks {
+		if p.tasks[i].Task == task {
+			p.tasks = append(p.tasks[:i], p.tasks[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *progress) Snapshot() []share.Progress {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]share.Progress(nil), p.tasks...)
+}
+
+// progressReader counts bytes towards a task as they're read.
+type progressReader struct {
+	io.Reader
+	progress *progress
+	task     string
+}
+
+func (r *progressReader) Read(buffer []byte) (int, error) {
+	n, err := r.Reader.Read(buffer)
+	r.progress.Add(r.task, int64(n))
+	return n, err
+}
@@ -0,0 +1,135 @@
+package tent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Source RCON packet types, which Factorio speaks.
+const (
+	rconResponse = 0
+	rconCommand  = 2
+	rconAuth     = 3
+)
+
+var ErrRconAuth = errors.New("rcon authentication failed")
+
+// rcon is a client for the game's RCON port, which the tent opens on localhost only.
+type rcon struct {
+	mutex    sync.Mutex
+	addr     string
+	password string
+	conn     net.Conn
+	nextID   int32
+}
+
+func NewRcon() *rcon {
+	port := os.Getenv("RCON_PORT")
+	if port == "" {
+		port = "27015"
+	}
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return &rcon{
+		addr:     "127.0.0.1:" + port,
+		password: hex.EncodeToString(secret),
+	}
+}
+
+// gameArgs are the command-line arguments that have the game listen for us.
+func (r *rcon) gameArgs() []string {
+	return []string{"--rcon-bind", r.addr, "--rcon-password", r.password}
+}
+
+// Command runs a console command and returns what it printed. It reconnects as needed, e.g. after a game restart.
+func (r *rcon) Command(command string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.conn == nil {
+		err := r.connect()
+		if err != nil {
+			return "", err
+		}
+	}
+	response, err := r.exchange(rconCommand, command)
+	if err != nil {
+		r.conn.Close()
+		r.conn = nil
+		return "", fmt.Errorf("rcon %q: %w", command, err)
+	}
+	return response, nil
+}
+
+func (r *rcon) connect() error {
+	conn, err := net.DialTimeout("tcp", r.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("connecting to rcon: %w", err)
+	}
+	r.conn = conn
+	_, err = r.exchange(rconAuth, r.password)
+	if err != nil {
+		conn.Close()
+		r.conn = nil
+		return err
+	}
+	return nil
+}
+
+// exchange sends one packet and reads the reply to it. The caller holds the mutex.
+func (r *rcon) exchange(kind int32, body string) (string, error) {
+	r.nextID++
+	id := r.nextID
+	r.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.LittleEndian, int32(4+4+len(body)+2))
+	binary.Write(&packet, binary.LittleEndian, id)
+	binary.Write(&packet, binary.LittleEndian, kind)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+	_, err := r.conn.Write(packet.Bytes())
+	if err != nil {
+		return "", err
+	}
+	for {
+		replyID, replyKind, replyBody, err := r.read()
+		if err != nil {
+			return "", err
+		}
+		if kind == rconAuth && replyID == -1 {
+			return "", ErrRconAuth
+		}
+		if kind == rconAuth && replyKind == rconResponse {
+			// an auth request gets an empty response packet before the real answer
+			continue
+		}
+		if replyID == id {
+			return replyBody, nil
+		}
+	}
+}
+
+func (r *rcon) read() (int32, int32, string, error) {
+	var header struct{ Size, ID, Kind int32 }
+	err := binary.Read(r.conn, binary.LittleEndian, &header)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if header.Size < 10 || header.Size > 1<<20 {
+		return 0, 0, "", fmt.Errorf("bad rcon packet size %d", header.Size)
+	}
+	body := make([]byte, header.Size-8)
+	_, err = io.ReadFull(r.conn, body)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return header.ID, header.Kind, string(bytes.TrimRight(body, "\x00")), nil
+}
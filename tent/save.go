@@ -0,0 +1,118 @@
+package tent
+
+import (
+	"errors"
+	"log/slog"
+	"mansionTent/share"
+	"slices"
+	"time"
+)
+
+// saveTimeout is how long a requested save may take, including the upload.
+const saveTimeout = 2 * time.Minute
+
+var (
+	ErrGameNotRunning = errors.New("game is not running")
+	ErrSaveTimeout    = errors.New("save took too long")
+)
+
+// requestSave asks the game to save, over RCON if it's listening, or through the console otherwise.
+func (s *sitter) requestSave() bool {
+	_, err := s.rcon.Command("/server-save")
+	if err == nil {
+		return true
+	}
+	slog.Debug("Saving through the console instead of RCON", "err", err)
+	_, err = s.stdin.Write([]byte("/server-save\n"))
+	return err == nil
+}
+
+func (s *sitter) save() bool {
+	if !s.running() {
+		return false
+	}
+	return s.requestSave()
+}
+
+// saveAndWait saves and waits for the save to be uploaded.
+func (s *sitter) saveAndWait() (share.SaveResult, error) {
+	if !s.running() {
+		return share.SaveResult{}, ErrGameNotRunning
+	}
+	return s.waitForSave()
+}
+
+// saveWaiter is someone waiting for a save they asked for at requested.
+type saveWaiter struct {
+	requested time.Time
+	done      chan share.SaveResult
+}
+
+func (s *sitter) waitForSave() (share.SaveResult, error) {
+	started := time.Now()
+	done := make(chan share.SaveResult, 1)
+	s.mutex.Lock()
+	s.saveWaiters = append(s.saveWaiters, saveWaiter{requested: started, done: done})
+	s.mutex.Unlock()
+	if !s.requestSave() {
+		s.stopWaiting(done)
+		return share.SaveResult{}, ErrGameNotRunning
+	}
+	select {
+	case result := <-done:
+		result.Duration = time.Since(started)
+		return result, nil
+	case <-time.After(saveTimeout):
+		s.stopWaiting(done)
+		return share.SaveResult{}, ErrSaveTimeout
+	}
+}
+
+// stopWaiting drops a waiter that gave up, so a later save doesn't answer it.
+func (s *sitter) stopWaiting(done chan share.SaveResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.saveWaiters = slices.DeleteFunc(s.saveWaiters, func(waiter saveWaiter) bool {
+		return waiter.done == done
+	})
+}
+
+// uploadSaved uploads a save that the game started writing at started, and lets everyone who asked for a save
+// before then know how it went. A save that was already underway when someone asked isn't theirs, so they
+// keep waiting for the next one.
+func (s *sitter) uploadSaved(started time.Time) {
+	result := s.hooks.onSaved()
+	s.mutex.Lock()
+	var satisfied []saveWaiter
+	waiting := s.saveWaiters[:0]
+	for _, waiter := range s.saveWaiters {
+		if waiter.requested.After(started) {
+			waiting = append(waiting, waiter)
+		} else {
+			satisfied = append(satisfied, waiter)
+		}
+	}
+	s.saveWaiters = waiting
+	s.mutex.Unlock()
+	for _, waiter := range satisfied {
+		waiter.done <- result
+	}
+}
+
+// scheduleSaves saves every SAVE_INTERVAL_MINUTES while anyone's playing. The game's own autosaves, every
+// autosave_interval in its server settings, keep running too, and get uploaded just the same.
+func (s *sitter) scheduleSaves() {
+	interval := parseFloatToMinutesOrDefault("SAVE_INTERVAL_MINUTES", 0)
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		if len(s.Status().Players) == 0 {
+			continue
+		}
+		slog.Info("Scheduled save")
+		if !s.save() {
+			slog.Warn("Scheduled save failed, game is not running")
+		}
+	}
+}
@@ -2,14 +2,18 @@ package tent
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"log/slog"
 	"mansionTent/share"
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -20,12 +24,22 @@ type regexpDispatch struct {
 
 type sitter struct {
 	hooks             *hooks
+	mutex             sync.Mutex
+	state             share.ServerState
+	version           string
+	started           time.Time
+	progress          progress
 	saveName          string
 	retry             bool
 	proc              *exec.Cmd
 	stdout            io.ReadCloser
 	stderr            io.ReadCloser
 	stdin             io.WriteCloser
+	gameLog           io.Writer
+	rcon              *rcon
+	saving            time.Time
+	onBooted          func() // called the first time the game is up
+	saveWaiters       []saveWaiter
 	players           share.Set[string]
 	nextShutdownCheck time.Time
 	regexps           []regexpDispatch
@@ -39,21 +53,32 @@ func NewSitter(hooks *hooks) *sitter {
 	s := &sitter{
 		hooks:    hooks,
 		saveName: "saves/world.zip",
+		state:    share.StateLaunching,
+		started:  time.Now(),
+		gameLog:  io.Discard,
+		rcon:     NewRcon(),
 	}
 	s.nextShutdownCheck = time.Now().Add(s.shutdownGrace.initial)
 	s.shutdownGrace.initial = parseFloatToMinutesOrDefault("SHUTDOWN_GRACE_INITIAL_MINUTES", 15)
 	s.shutdownGrace.drained = parseFloatToMinutesOrDefault("SHUTDOWN_GRACE_DRAINED_MINUTES", 3)
 	s.regexps = []regexpDispatch{
+		{s.onVersion, *regexp.MustCompile(`^\s*\d+\.\d+ ....-..-.. ..:..:..; Factorio (\S+) \(build`)},
 		{s.onInGame, *regexp.MustCompile(`^\s*\d+\.\d+ Info ServerMultiplayerManager\.cpp:\d+: updateTick\(\d+\) changing state from\(CreatingGame\) to\(InGame\)$`)},
 		{s.onJoined, *regexp.MustCompile(`^....-..-.. ..:..:.. \[JOIN] (.+) joined the game$`)},
 		{s.onLeft, *regexp.MustCompile(`^....-..-.. ..:..:.. \[LEAVE] (.+) left the game$`)},
+		{s.onSaving, *regexp.MustCompile(`^\s*\d+\.\d+ Info AppManagerStates\.cpp:\d+: Saving to .+ \((non-)?blocking\)\.?$`)},
 		{s.onSaved, *regexp.MustCompile(`^\s*\d+\.\d+ Info AppManagerStates\.cpp:\d+: Saving finished$`)},
 		{s.onQuitCmd, *regexp.MustCompile(`^\s*\d+\.\d+ Quitting: remote-quit.$`)},
 	}
+	s.observeMetrics()
 	return s
 }
 
 func parseFloatToMinutesOrDefault(key string, def float64) time.Duration {
+	return parseFloatDurationOrDefault(key, def, time.Minute)
+}
+
+func parseFloatDurationOrDefault(key string, def float64, unit time.Duration) time.Duration {
 	value := def
 	str := os.Getenv(key)
 	if str != "" {
@@ -64,45 +89,107 @@ func parseFloatToMinutesOrDefault(key string, def float64) time.Duration {
 			value = parsed
 		}
 	}
-	return time.Duration(value * float64(time.Minute))
+	return time.Duration(value * float64(unit))
+}
+
+func parseIntOrDefault(key string, def int) int {
+	str := os.Getenv(key)
+	if str == "" {
+		return def
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		slog.Warn("Invalid integer", "key", key, "value", str, "err", err)
+		return def
+	}
+	return value
+}
+
+func (s *sitter) Status() share.Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return share.Status{
+		State:    s.state,
+		Players:  s.players.Values(),
+		Version:  s.version,
+		Started:  s.started,
+		Progress: s.progress.Snapshot(),
+	}
 }
 
-func (s *sitter) Run() {
+func (s *sitter) setState(state share.ServerState) {
+	s.mutex.Lock()
+	s.state = state
+	s.mutex.Unlock()
+	s.reportState()
+}
+
+// reportState lets the tower know about a state change without waiting to be asked.
+func (s *sitter) reportState() {
+	s.hooks.onStateChanged(s.Status())
+}
+
+func (s *sitter) Run() error {
+	go s.watchdog()
+	go s.onTerminate()
+	go s.monitorPerformance()
+	go s.scheduleSaves()
 	for s.retry = true; s.retry; {
-		s.launch()
+		err := s.launch()
+		if err != nil {
+			return err
+		}
 		go s.watchForShutdown()
 		go io.Copy(s.stdin, os.Stdin)
-		go s.parseAndPass(os.Stderr, s.stderr)
-		s.parseAndPass(os.Stdout, s.stdout)
+		go s.parseAndPass(io.MultiWriter(os.Stderr, s.gameLog), s.stderr)
+		s.parseAndPass(io.MultiWriter(os.Stdout, s.gameLog), s.stdout)
+		if s.retry {
+			slog.Warn("Game exited without quitting, restarting")
+			metrics.Add("tent_game_restarts_total", 1)
+			s.hooks.onCrashed()
+		}
 	}
-	s.poweroff()
+	s.hooks.onStopped()
+	return s.poweroff()
 }
 
-func (s *sitter) launch() {
+func (s *sitter) launch() error {
 	var err error
 	slog.Info("Launching game", "save", s.saveName)
-	s.proc = exec.Command("bin/x64/factorio", "--start-server", s.saveName)
+	binary := findGameBinary(".")
+	if binary == "" {
+		return fmt.Errorf("no game binary under bin/")
+	}
+	args := append([]string{"--start-server", s.saveName}, s.rcon.gameArgs()...)
+	proc, err := gameCommand(binary, args...)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.proc = proc
+	s.mutex.Unlock()
 	s.stdout, err = s.proc.StdoutPipe()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	s.stderr, err = s.proc.StderrPipe()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	s.stdin, err = s.proc.StdinPipe()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	err = s.proc.Start()
 	if err != nil {
 		cwd, _ := os.Getwd()
-		slog.Info("Working directory", "cwd", cwd)
-		panic(err)
+		return fmt.Errorf("starting game in %s: %w", cwd, err)
 	}
+	s.progress.Set(taskMap, 0, 0, "")
+	return nil
 }
 
-func (s *sitter) parseAndPass(out *os.File, in io.ReadCloser) {
+func (s *sitter) parseAndPass(out io.Writer, in io.ReadCloser) {
 	scanner := bufio.NewScanner(in)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -118,26 +205,65 @@ func (s *sitter) parseAndPass(out *os.File, in io.ReadCloser) {
 	}
 }
 
+func (s *sitter) onVersion(match []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.version = match[1]
+}
+
 func (s *sitter) onInGame(_ []string) {
+	s.progress.Clear(taskMap)
+	s.setState(share.StateInGame)
 	s.nextShutdownCheck = time.Now().Add(s.shutdownGrace.initial)
-	go s.hooks.onLaunched()
+	sdNotify("READY=1\nSTATUS=In game")
+	if s.onBooted != nil {
+		s.onBooted()
+		s.onBooted = nil
+	}
+	s.hooks.onLaunched()
+}
+
+func (s *sitter) onSaving(_ []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.saving = time.Now()
 }
 
 func (s *sitter) onSaved(_ []string) {
-	go s.hooks.onSaved()
+	s.mutex.Lock()
+	// the game always says it's saving first, but if that line was missed, the save counts as just started
+	started := time.Now()
+	if !s.saving.IsZero() {
+		metrics.Observe("tent_save_duration_seconds", time.Since(s.saving).Seconds())
+		started = s.saving
+		s.saving = time.Time{}
+	}
+	s.mutex.Unlock()
+	go s.uploadSaved(started)
 }
 
 func (s *sitter) onJoined(match []string) {
+	s.mutex.Lock()
 	s.players.Add(match[1])
-	go s.hooks.onJoined(match[1])
+	s.state = share.StateInGame
+	s.mutex.Unlock()
+	s.reportState()
+	s.hooks.onJoined(match[1])
 }
 
 func (s *sitter) onLeft(match []string) {
+	s.mutex.Lock()
 	s.players.Remove(match[1])
+	drained := s.players.Len() == 0
+	if drained {
+		s.state = share.StateDraining
+	}
+	s.mutex.Unlock()
+	s.reportState()
 	s.bumpShutdownCheck()
-	go s.hooks.onLeft(match[1])
-	if s.players.Len() == 0 {
-		go s.hooks.onDrained(time.Until(s.nextShutdownCheck))
+	s.hooks.onLeft(match[1])
+	if drained {
+		s.hooks.onDrained(time.Until(s.nextShutdownCheck))
 	}
 }
 
@@ -161,18 +287,84 @@ func (s *sitter) watchForShutdown() {
 			s.bumpShutdownCheck()
 		}
 	}
+	s.shutdown()
+}
+
+func (s *sitter) shutdown() {
+	s.mutex.Lock()
+	if s.state == share.StateStopped {
+		s.mutex.Unlock()
+		return
+	}
+	wasRunning := s.state == share.StateInGame || s.state == share.StateDraining
+	s.state = share.StateStopped
+	s.mutex.Unlock()
+	s.reportState()
 	// time to shut down!
 	slog.Info("Shutting down")
+	sdNotify("STOPPING=1")
+	if wasRunning {
+		// the game saves on the way out too, but this way the save is safely in S3 before anything can go wrong
+		_, err := s.waitForSave()
+		if err != nil {
+			slog.Warn("Error saving before shutdown", "err", err)
+		}
+	}
 	s.hooks.onQuit()
 	s.stdin.Write([]byte("/quit\n"))
 	s.retry = false
 }
 
-func (s *sitter) poweroff() {
+// gamePid is the game's process ID, or zero if it isn't running.
+func (s *sitter) gamePid() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.proc == nil || s.proc.Process == nil || s.proc.ProcessState != nil {
+		return 0
+	}
+	return s.proc.Process.Pid
+}
+
+func (s *sitter) running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state == share.StateInGame || s.state == share.StateDraining
+}
+
+// onTerminate quits the game properly when the service is stopped, e.g. by systemctl stop.
+func (s *sitter) onTerminate() {
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM)
+	<-terminate
+	slog.Info("Terminated")
+	s.shutdown()
+}
+
+// watchdog pings systemd for as long as the sitter keeps answering, if the unit asked for it.
+func (s *sitter) watchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval / 2) {
+		status := s.Status()
+		sdNotify(fmt.Sprintf("WATCHDOG=1\nSTATUS=%s, %d online", status.State, len(status.Players)))
+	}
+}
+
+func (s *sitter) poweroff() error {
+	s.hooks.flush()
+	share.FlushTracing()
+	if systemdPowersOff() {
+		// the unit powers off once we exit cleanly, after its own stop logic
+		slog.Info("Exiting for systemd to power off")
+		return nil
+	}
 	slog.Info("Powering off")
 	cmd := exec.Command("sudo", "shutdown", "-h", "now")
 	err := cmd.Run()
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("powering off: %w", err)
 	}
+	return nil
 }
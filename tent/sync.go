@@ -0,0 +1,521 @@
+package tent
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const manifestName = ".mt-manifest.json"
+
+// Paths that are never synced: the game install itself, runtime leftovers, and the tower's own files in the bucket.
+var defaultSyncExclude = []string{
+	manifestName, "bin/**", "data/**", "doc-html/**", "temp/**", "config-path.cfg",
+	".lock", "*.log", "*.tmp", "mt.*", "logs/**",
+}
+
+// manifestEntry is what a file looked like, on both sides, the last time it was synced.
+type manifestEntry struct {
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+// syncEngine keeps the local game directory and the S3 prefix in step.
+// The manifest is what lets it tell "deleted over there" apart from "new over here".
+type syncEngine struct {
+	s3      *s3.S3
+	bucket  string
+	prefix  string
+	root    string
+	include []string
+	exclude []string
+	// files go up and come down fileConcurrency at a time, and each one bigger than a part in parts,
+	// concurrency at a time, so there can be up to fileConcurrency × concurrency requests at once
+	partSize        int64
+	concurrency     int
+	fileConcurrency int
+	mutex           sync.Mutex
+	manifest        map[string]manifestEntry
+	// pushing lets one Push or Upload run at a time, since two uploads of a save would trample each other's parts
+	pushing sync.Mutex
+	// started is the multipart uploads this process began, which are never resumed, guarded by mutex
+	started map[string]bool
+}
+
+func NewSyncEngine(client *s3.S3, bucket, prefix, root string) *syncEngine {
+	if prefix != "" {
+		prefix += "/"
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		absRoot = root
+	}
+	e := &syncEngine{
+		s3:              client,
+		bucket:          bucket,
+		prefix:          prefix,
+		root:            absRoot,
+		include:         splitGlobs(os.Getenv("SYNC_INCLUDE")),
+		exclude:         append(splitGlobs(os.Getenv("SYNC_EXCLUDE")), defaultSyncExclude...),
+		partSize:        max(int64(parseIntOrDefault("SYNC_PART_MB", 16))<<20, minPartSize),
+		concurrency:     max(parseIntOrDefault("SYNC_CONCURRENCY", 4), 1),
+		fileConcurrency: max(parseIntOrDefault("SYNC_FILE_CONCURRENCY", 5), 1),
+		manifest:        make(map[string]manifestEntry),
+		started:         make(map[string]bool),
+	}
+	return e
+}
+
+func splitGlobs(value string) []string {
+	var globs []string
+	for _, glob := range strings.Split(value, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+	return globs
+}
+
+// matchGlob is path.Match with "**" standing for any number of directories.
+// Patterns without a slash match the file name at any depth, like .gitignore.
+func matchGlob(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func (e *syncEngine) wanted(rel string) bool {
+	for _, glob := range e.exclude {
+		if matchGlob(glob, rel) {
+			return false
+		}
+	}
+	if len(e.include) == 0 {
+		return true
+	}
+	for _, glob := range e.include {
+		if matchGlob(glob, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *syncEngine) localPath(rel string) string {
+	return filepath.Join(e.root, filepath.FromSlash(rel))
+}
+
+func (e *syncEngine) loadManifest() error {
+	data, err := os.ReadFile(e.localPath(manifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return json.Unmarshal(data, &e.manifest)
+}
+
+func (e *syncEngine) saveManifest() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	data, err := json.MarshalIndent(e.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	target := e.localPath(manifestName)
+	err = os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+	temp := target + ".tmp"
+	err = os.WriteFile(temp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, target)
+}
+
+func (e *syncEngine) record(rel string, entry manifestEntry) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.manifest[rel] = entry
+}
+
+func (e *syncEngine) forget(rel string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.manifest, rel)
+}
+
+func (e *syncEngine) lookup(rel string) (manifestEntry, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	entry, ok := e.manifest[rel]
+	return entry, ok
+}
+
+// listRemote returns every wanted object under the prefix, keyed by relative path.
+func (e *syncEngine) listRemote() (map[string]*s3.Object, error) {
+	remote := make(map[string]*s3.Object)
+	request := &s3.ListObjectsV2Input{
+		Bucket: aws.String(e.bucket),
+		Prefix: aws.String(e.prefix),
+	}
+	err := e.s3.ListObjectsV2Pages(request, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			if object.Key == nil || strings.HasSuffix(*object.Key, "/") {
+				continue
+			}
+			rel := strings.TrimPrefix(*object.Key, e.prefix)
+			if e.wanted(rel) {
+				remote[rel] = object
+			}
+		}
+		return true
+	})
+	return remote, err
+}
+
+// listLocal returns every wanted file under the root, as relative slash-separated paths.
+func (e *syncEngine) listLocal() ([]string, error) {
+	var local []string
+	err := filepath.WalkDir(e.root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(e.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if e.wanted(rel) {
+			local = append(local, rel)
+		}
+		return nil
+	})
+	return local, err
+}
+
+func fileMD5(name string) (string, int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := md5.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+func cleanETag(etag *string) string {
+	return strings.Trim(aws.StringValue(etag), `"`)
+}
+
+// current reports whether the local copy of rel should be kept rather than replaced by a remote object:
+// either it matches, or only the local side changed since the last sync and it's waiting for Push.
+func (e *syncEngine) current(rel string, object *s3.Object) (bool, error) {
+	localMD5, size, err := fileMD5(e.localPath(rel))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	etag := cleanETag(object.ETag)
+	if size == aws.Int64Value(object.Size) && localMD5 == etag {
+		e.record(rel, manifestEntry{ETag: etag, Size: size, MD5: localMD5})
+		return true, nil
+	}
+	// multipart ETags aren't an MD5, so go by what we saw last time
+	entry, synced := e.lookup(rel)
+	if !synced || entry.ETag != etag {
+		return false, nil
+	}
+	if entry.MD5 != localMD5 {
+		// S3 still has what we last synced, so the local copy is newer, e.g. the last Push failed
+		slog.Info("Keeping local change", "file", rel)
+	}
+	return true, nil
+}
+
+// Pull brings the local tree in line with S3: changed and new objects are downloaded,
+// and files that were deleted from S3 since the last sync are deleted here too.
+// onProgress, if not nil, is told how many of the changed files are done so far.
+func (e *syncEngine) Pull(onProgress func(done, total int)) error {
+	err := e.loadManifest()
+	if err != nil {
+		return fmt.Errorf("loading sync manifest: %w", err)
+	}
+	remote, err := e.listRemote()
+	if err != nil {
+		return fmt.Errorf("listing %s: %w", e.prefix, err)
+	}
+	// nothing else uploads while the tent boots, so this is the time to tidy up after tents that died mid-upload
+	err = e.AbortAbandonedUploads()
+	if err != nil {
+		slog.Warn("Error cleaning up abandoned uploads", "err", err)
+	}
+	var stale []string
+	for rel, object := range remote {
+		ok, err := e.current(rel, object)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			stale = append(stale, rel)
+		}
+	}
+	slog.Info("Pulling state", "remote", len(remote), "changed", len(stale))
+	var done atomic.Int64
+	if onProgress != nil {
+		onProgress(0, len(stale))
+	}
+	err = e.parallel(stale, func(rel string) error {
+		err := e.download(rel, remote[rel])
+		if err != nil && isSave(rel) {
+			// one bad save isn't worth failing the boot over, since chooseSave can fall back to another.
+			// Any older copy here stays, along with its manifest entry, so Push won't send it over S3's.
+			slog.Warn("Skipping save that didn't download", "file", rel, "err", err)
+			if _, statErr := os.Stat(e.localPath(rel)); errors.Is(statErr, fs.ErrNotExist) {
+				e.forget(rel)
+			}
+			err = nil
+		}
+		if err == nil && onProgress != nil {
+			onProgress(int(done.Add(1)), len(stale))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	local, err := e.listLocal()
+	if err != nil {
+		return err
+	}
+	for _, rel := range local {
+		if _, ok := remote[rel]; ok {
+			continue
+		}
+		if _, synced := e.lookup(rel); synced {
+			slog.Info("Removing file deleted from S3", "file", rel)
+			err = os.Remove(e.localPath(rel))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			e.forget(rel)
+		}
+	}
+	return e.saveManifest()
+}
+
+// Push sends local changes back to S3: changed and new files are uploaded,
+// and files that were deleted here since the last sync are deleted from S3.
+func (e *syncEngine) Push() error {
+	e.pushing.Lock()
+	defer e.pushing.Unlock()
+	local, err := e.listLocal()
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(local))
+	var changed []string
+	for _, rel := range local {
+		present[rel] = true
+		localMD5, _, err := fileMD5(e.localPath(rel))
+		if err != nil {
+			return err
+		}
+		entry, ok := e.lookup(rel)
+		if ok && entry.MD5 == localMD5 {
+			continue
+		}
+		// a damaged save would replace the good copy in S3, so it stays local
+		if isSave(rel) {
+			if err := checkSave(e.localPath(rel)); err != nil {
+				slog.Warn("Not pushing damaged save", "err", err)
+				continue
+			}
+		}
+		changed = append(changed, rel)
+	}
+	slog.Info("Pushing state", "local", len(local), "changed", len(changed))
+	err = e.parallel(changed, e.upload)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	var deleted []string
+	for rel := range e.manifest {
+		if !present[rel] && e.wanted(rel) {
+			deleted = append(deleted, rel)
+		}
+	}
+	e.mutex.Unlock()
+	for _, rel := range deleted {
+		slog.Info("Removing file deleted locally from S3", "file", rel)
+		_, err = e.s3.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(e.bucket),
+			Key:    aws.String(e.prefix + rel),
+		})
+		if err != nil {
+			return fmt.Errorf("deleting %s: %w", rel, err)
+		}
+		e.forget(rel)
+	}
+	return e.saveManifest()
+}
+
+// parallel runs fn over names, SYNC_FILE_CONCURRENCY at a time, and returns the first error.
+func (e *syncEngine) parallel(names []string, fn func(string) error) error {
+	return inParallel(e.fileConcurrency, len(names), func(i int) error {
+		return fn(names[i])
+	})
+}
+
+// download writes to a temp file beside the destination and only renames it into place once the
+// contents check out, so a cut-off download never leaves a half-written file where the game would load it.
+// Objects bigger than a part are fetched in ranges, in parallel.
+func (e *syncEngine) download(rel string, object *s3.Object) error {
+	destPath := e.localPath(rel)
+	slog.Debug("Downloading", "file", *object.Key, "to", destPath)
+	err := os.MkdirAll(filepath.Dir(destPath), 0o755)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(destPath), "."+filepath.Base(destPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	var etag string
+	var size int64
+	if aws.Int64Value(object.Size) > e.partSize {
+		etag, size, err = e.downloadRanges(rel, object, file)
+	} else {
+		etag, size, err = e.downloadWhole(rel, object, file)
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	} else if closeErr != nil {
+		return closeErr
+	}
+	sum, written, err := fileMD5(file.Name())
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("downloading %s: wrote %d of %d bytes", rel, written, size)
+	}
+	// multipart ETags have a -partcount on the end and aren't an MD5 of the whole object
+	if !strings.Contains(etag, "-") && etag != sum {
+		return fmt.Errorf("downloading %s: MD5 %s doesn't match ETag %s", rel, sum, etag)
+	}
+	err = os.Rename(file.Name(), destPath)
+	if err != nil {
+		return err
+	}
+	e.record(rel, manifestEntry{ETag: etag, Size: size, MD5: sum})
+	return nil
+}
+
+// Upload sends one local file to S3 and records it in the manifest right away.
+func (e *syncEngine) Upload(rel string) error {
+	e.pushing.Lock()
+	defer e.pushing.Unlock()
+	err := e.upload(rel)
+	if err != nil {
+		return err
+	}
+	return e.saveManifest()
+}
+
+// upload sends small files in one request and bigger ones through uploadMultipart, retrying either way.
+func (e *syncEngine) upload(rel string) error {
+	localMD5, size, err := fileMD5(e.localPath(rel))
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(e.localPath(rel))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	slog.Debug("Uploading", "file", rel, "size", size)
+	var etag string
+	if size > e.partSize {
+		etag, err = e.uploadMultipart(rel, file, size)
+		if err != nil {
+			return err
+		}
+	} else {
+		sum, _ := hex.DecodeString(localMD5)
+		err = retry(rel, func() error {
+			response, err := e.s3.PutObject(&s3.PutObjectInput{
+				Bucket:     aws.String(e.bucket),
+				Key:        aws.String(e.prefix + rel),
+				Body:       io.NewSectionReader(file, 0, size),
+				ContentMD5: aws.String(base64.StdEncoding.EncodeToString(sum)),
+			})
+			if err == nil {
+				etag = cleanETag(response.ETag)
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", rel, err)
+		}
+	}
+	e.record(rel, manifestEntry{ETag: etag, Size: size, MD5: localMD5})
+	return nil
+}
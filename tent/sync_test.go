@@ -0,0 +1,196 @@
+package tent
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestSyncEngine(t *testing.T, include, exclude string) *syncEngine {
+	t.Helper()
+	t.Setenv("SYNC_INCLUDE", include)
+	t.Setenv("SYNC_EXCLUDE", exclude)
+	return NewSyncEngine(nil, "bucket", "prefix", t.TempDir())
+}
+
+func writeLocal(t *testing.T, e *syncEngine, rel, content string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(e.localPath(rel)), 0o755)
+	if err == nil {
+		err = os.WriteFile(e.localPath(rel), []byte(content), 0o644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	const multipart = "0123456789abcdef0123456789abcdef-3"
+	cases := []struct {
+		name     string
+		local    string // "" means there's no local copy
+		remote   string // the remote object's ETag
+		size     int64
+		manifest *manifestEntry
+		want     bool
+	}{
+		{"same on both sides", "v1", md5Hex("v1"), 2, nil, true},
+		{"missing locally", "", md5Hex("v1"), 2, nil, false},
+		{"never synced and different", "v2", md5Hex("v1"), 2, nil, false},
+		{"remote changed", "v1", md5Hex("v2"), 2, &manifestEntry{ETag: md5Hex("v1"), Size: 2, MD5: md5Hex("v1")}, false},
+		{"local changed", "v2", md5Hex("v1"), 2, &manifestEntry{ETag: md5Hex("v1"), Size: 2, MD5: md5Hex("v1")}, true},
+		// a conflict goes to S3, which is what the other tent pushed last
+		{"both changed", "v3", md5Hex("v2"), 2, &manifestEntry{ETag: md5Hex("v1"), Size: 2, MD5: md5Hex("v1")}, false},
+		{"multipart unchanged", "v1", multipart, 2, &manifestEntry{ETag: multipart, Size: 2, MD5: md5Hex("v1")}, true},
+		{"multipart replaced", "v1", multipart, 2, &manifestEntry{ETag: "fedcba9876543210fedcba9876543210-3", Size: 2, MD5: md5Hex("v1")}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := newTestSyncEngine(t, "", "")
+			rel := "saves/world.zip"
+			if c.local != "" {
+				writeLocal(t, e, rel, c.local)
+			}
+			if c.manifest != nil {
+				e.record(rel, *c.manifest)
+			}
+			object := &s3.Object{Key: aws.String("prefix/" + rel), ETag: aws.String(`"` + c.remote + `"`), Size: aws.Int64(c.size)}
+			got, err := e.current(rel, object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("current() = %v, want %v", got, c.want)
+			}
+			if entry, _ := e.lookup(rel); got && c.manifest == nil && entry.ETag != c.remote {
+				t.Errorf("manifest has %+v for a file that matches S3", entry)
+			}
+		})
+	}
+}
+
+func TestWanted(t *testing.T) {
+	cases := []struct {
+		include, exclude string
+		rel              string
+		want             bool
+	}{
+		{"", "", "saves/world.zip", true},
+		{"", "", "mods/mod-list.json", true},
+		{"", "", manifestName, false},
+		{"", "", "bin/x64/factorio", false},
+		{"", "", "data/base/info.json", false},
+		{"", "", "factorio-current.log", false},
+		{"", "", "saves/.world.zip.123.tmp", false},
+		{"", "", "mt.env", false},
+		{"", "saves/_autosave*.zip", "saves/_autosave1.zip", false},
+		{"", "saves/_autosave*.zip", "saves/world.zip", true},
+		{"saves/**,mods/*", "", "saves/old/world.zip", true},
+		{"saves/**,mods/*", "", "mods/mod-list.json", true},
+		{"saves/**,mods/*", "", "mods/settings/deep.dat", false},
+		{"saves/**,mods/*", "", "config/config.ini", false},
+		// excludes win over includes, and the defaults always apply
+		{"saves/**", "*.bak", "saves/world.zip.bak", false},
+		{"**", "", "temp/currently-playing.dat", false},
+	}
+	for _, c := range cases {
+		e := newTestSyncEngine(t, c.include, c.exclude)
+		if got := e.wanted(c.rel); got != c.want {
+			t.Errorf("include %q exclude %q: wanted(%q) = %v, want %v", c.include, c.exclude, c.rel, got, c.want)
+		}
+	}
+}
+
+func TestListLocalSkipsExcludedFiles(t *testing.T) {
+	e := newTestSyncEngine(t, "", "saves/_autosave*.zip")
+	for _, rel := range []string{"saves/world.zip", "saves/_autosave1.zip", "mods/mod-list.json", "factorio-current.log", "bin/x64/factorio", manifestName} {
+		writeLocal(t, e, rel, rel)
+	}
+	local, err := e.listLocal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(local)
+	if want := []string{"mods/mod-list.json", "saves/world.zip"}; !slices.Equal(local, want) {
+		t.Errorf("listLocal() = %v, want %v", local, want)
+	}
+}
+
+// fakeS3 takes puts and deletes of single objects and notes which keys they were for.
+type fakeS3 struct {
+	mutex   sync.Mutex
+	puts    []string
+	deletes []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.puts = append(f.puts, r.URL.Path)
+		w.Header().Set("ETag", `"`+md5Hex(string(body))+`"`)
+	case http.MethodDelete:
+		f.deletes = append(f.deletes, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestPushSkipsWhatHasNotChanged(t *testing.T) {
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	e := newTestSyncEngine(t, "", "")
+	e.s3 = s3.New(session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})))
+	writeLocal(t, e, "mods/unchanged.zip", "same")
+	e.record("mods/unchanged.zip", manifestEntry{ETag: md5Hex("same"), Size: 4, MD5: md5Hex("same")})
+	writeLocal(t, e, "mods/changed.zip", "new")
+	e.record("mods/changed.zip", manifestEntry{ETag: md5Hex("old"), Size: 3, MD5: md5Hex("old")})
+	writeLocal(t, e, "mods/added.zip", "added")
+	writeLocal(t, e, "factorio-current.log", "excluded")
+	e.record("mods/removed.zip", manifestEntry{ETag: md5Hex("gone"), Size: 4, MD5: md5Hex("gone")})
+
+	err := e.Push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(fake.puts)
+	if want := []string{"/bucket/prefix/mods/added.zip", "/bucket/prefix/mods/changed.zip"}; !slices.Equal(fake.puts, want) {
+		t.Errorf("uploaded %v, want %v", fake.puts, want)
+	}
+	if want := []string{"/bucket/prefix/mods/removed.zip"}; !slices.Equal(fake.deletes, want) {
+		t.Errorf("deleted %v, want %v", fake.deletes, want)
+	}
+	if entry, _ := e.lookup("mods/changed.zip"); entry.MD5 != md5Hex("new") || entry.ETag != md5Hex("new") {
+		t.Errorf("manifest has %+v for the changed file", entry)
+	}
+	if _, ok := e.lookup("mods/removed.zip"); ok {
+		t.Error("manifest still has the removed file")
+	}
+}
@@ -0,0 +1,50 @@
+package tent
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemdPowersOff reports whether the tent runs as the unit from the user-data, which powers off once
+// the tent exits. Any systemd service has INVOCATION_ID, so the unit sets MT_SYSTEMD_POWEROFF to say so.
+func systemdPowersOff() bool {
+	return os.Getenv("MT_SYSTEMD_POWEROFF") == "1"
+}
+
+// sdNotify sends a state like READY=1 to the service manager, per sd_notify(3).
+// Outside of a Type=notify unit it does nothing.
+func sdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	if path[0] == '@' {
+		// abstract namespace
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Error notifying systemd", "state", state, "err", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		slog.Warn("Error notifying systemd", "state", state, "err", err)
+	}
+}
+
+// watchdogInterval is how often systemd expects to hear from us, or zero if the unit has no watchdog.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,94 @@
+package tower
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// useElasticIP reports whether the tent should keep the same public IP across launches.
+func useElasticIP() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("EC2_ELASTIC_IP"))
+	return enabled
+}
+
+func (l *dispatcher) findElasticIP() (*ec2.Address, error) {
+	resp, err := l.ec2.DescribeAddresses(&ec2.DescribeAddressesInput{Filters: []*ec2.Filter{{
+		Name:   aws.String("tag:Name"),
+		Values: []*string{aws.String(os.Getenv("EC2_NAME_TAG"))},
+	}, {
+		Name:   aws.String("tag:" + managedTag),
+		Values: []*string{aws.String("elastic-ip")},
+	}}})
+	if err != nil {
+		return nil, fmt.Errorf("describing addresses: %w", err)
+	}
+	if len(resp.Addresses) == 0 {
+		return nil, nil
+	}
+	return resp.Addresses[0], nil
+}
+
+// findOrAllocateElasticIP reuses our tagged Elastic IP, or allocates one the first time.
+func (l *dispatcher) findOrAllocateElasticIP() (*ec2.Address, error) {
+	address, err := l.findElasticIP()
+	if err != nil || address != nil {
+		return address, err
+	}
+	allocated, err := l.ec2.AllocateAddress(&ec2.AllocateAddressInput{
+		Domain: aws.String(ec2.DomainTypeVpc),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeElasticIp),
+			Tags: []*ec2.Tag{
+				{Key: aws.String("Name"), Value: aws.String(os.Getenv("EC2_NAME_TAG"))},
+				{Key: aws.String(managedTag), Value: aws.String("elastic-ip")},
+			},
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("allocating elastic IP: %w", err)
+	}
+	slog.Info("Allocated elastic IP", "ip", *allocated.PublicIp, "id", *allocated.AllocationId)
+	return &ec2.Address{AllocationId: allocated.AllocationId, PublicIp: allocated.PublicIp}, nil
+}
+
+func (l *dispatcher) associateElasticIP(instanceID string) (string, error) {
+	address, err := l.findOrAllocateElasticIP()
+	if err != nil {
+		return "", err
+	}
+	_, err = l.ec2.AssociateAddress(&ec2.AssociateAddressInput{
+		AllocationId:       address.AllocationId,
+		InstanceId:         aws.String(instanceID),
+		AllowReassociation: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("associating elastic IP: %w", err)
+	}
+	slog.Debug("Associated elastic IP", "ip", *address.PublicIp, "instance", instanceID)
+	return *address.PublicIp, nil
+}
+
+// releaseElasticIP gives the address back to AWS. After this, the next launch gets a different IP.
+func (l *dispatcher) releaseElasticIP() error {
+	address, err := l.findElasticIP()
+	if err != nil || address == nil {
+		return err
+	}
+	if address.AssociationId != nil {
+		_, err = l.ec2.DisassociateAddress(&ec2.DisassociateAddressInput{AssociationId: address.AssociationId})
+		if err != nil {
+			return fmt.Errorf("disassociating elastic IP: %w", err)
+		}
+	}
+	_, err = l.ec2.ReleaseAddress(&ec2.ReleaseAddressInput{AllocationId: address.AllocationId})
+	if err != nil {
+		return fmt.Errorf("releasing elastic IP: %w", err)
+	}
+	slog.Info("Released elastic IP", "ip", *address.PublicIp)
+	return nil
+}
@@ -0,0 +1,93 @@
+package tower
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// architecture is a CPU architecture as EC2 names it, with the matching Go and tent binary names.
+type architecture struct {
+	ec2    string
+	goarch string
+	suffix string
+}
+
+var (
+	archX64   = architecture{ec2: ec2.ArchitectureTypeX8664, goarch: "amd64", suffix: "x64"}
+	archArm64 = architecture{ec2: ec2.ArchitectureTypeArm64, goarch: "arm64", suffix: "arm64"}
+)
+
+// binaryName is the tent executable for this architecture, both in S3 and on the instance.
+func (a architecture) binaryName() string {
+	return "mt." + a.suffix
+}
+
+// instanceArchitecture asks EC2 what EC2_INSTANCE_TYPE runs on. Graviton types are arm64-only.
+func (l *dispatcher) instanceArchitecture() (architecture, error) {
+	instanceType := os.Getenv("EC2_INSTANCE_TYPE")
+	resp, err := l.ec2.DescribeInstanceTypes(&ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []*string{aws.String(instanceType)},
+	})
+	if err != nil {
+		return architecture{}, fmt.Errorf("describing instance type %s: %w", instanceType, err)
+	}
+	if len(resp.InstanceTypes) == 0 || resp.InstanceTypes[0].ProcessorInfo == nil {
+		return architecture{}, fmt.Errorf("unknown instance type %s", instanceType)
+	}
+	supported := aws.StringValueSlice(resp.InstanceTypes[0].ProcessorInfo.SupportedArchitectures)
+	if slices.Contains(supported, archX64.ec2) {
+		return archX64, nil
+	}
+	if slices.Contains(supported, archArm64.ec2) {
+		return archArm64, nil
+	}
+	return architecture{}, fmt.Errorf("instance type %s runs on %v, which we have no build for", instanceType, supported)
+}
+
+// uploadExecutables uploads a tent binary for every architecture we have one for.
+// The running binary covers its own architecture; the others are expected next to it, named like mt.arm64.
+// Only the one the instance type needs is required.
+func (l *dispatcher) uploadExecutables() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	base := executable[:len(executable)-len(filepath.Ext(executable))]
+	for _, arch := range []architecture{archX64, archArm64} {
+		path := base + "." + arch.suffix
+		if runtime.GOOS == "linux" && runtime.GOARCH == arch.goarch {
+			path = executable
+		}
+		err := l.uploadExecutable(path, arch.binaryName())
+		if errors.Is(err, os.ErrNotExist) && arch != l.arch {
+			slog.Debug("No tent binary for architecture", "arch", arch.ec2, "path", path)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *dispatcher) uploadExecutable(path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening tent executable: %w", err)
+	}
+	defer file.Close()
+	err = l.UploadToS3(name, file)
+	if err != nil {
+		return fmt.Errorf("uploading tent executable: %w", err)
+	}
+	slog.Info("Uploaded", "file", file.Name(), "as", name)
+	return nil
+}
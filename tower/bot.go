@@ -1,10 +1,14 @@
 package tower
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"mansionTent/share"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -15,16 +19,50 @@ type botIds struct {
 
 type bot struct {
 	dispatcher *dispatcher
+	tent       *tentClient
+	lifecycle  *lifecycle
+	board      *statusBoard
 	session    *discordgo.Session
 	ids        botIds
 }
 
+var ErrNotRunning = errors.New("server is not running")
+
+// userMessage explains an error to players, who can't do much about AWS internals.
+func userMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrAlreadyRunning):
+		return "The server is already running."
+	case errors.Is(err, ErrNotRunning):
+		return "The server isn't running."
+	case errors.Is(err, ErrNoAMI):
+		return "Couldn't find a machine image to launch. An admin should check AWS_REGION."
+	case errors.Is(err, ErrNoSecurityGroup):
+		return "Couldn't set up the server's firewall. An admin should check the EC2 permissions."
+	case errors.Is(err, ErrInstanceNotFound):
+		return "The server vanished right after launching. Try again in a minute."
+	case errors.Is(err, ErrInstanceHasNoIP):
+		return "The server has no public IP. An admin should check EC2_SUBNET_ID."
+	case errors.Is(err, ErrPhaseTimeout):
+		return "The server seems stuck: " + err.Error()
+	default:
+		return "Something went wrong: " + err.Error()
+	}
+}
+
 func RunBot() {
 	NewBot().Run()
 }
 
 func NewBot() *bot {
-	b := &bot{dispatcher: NewDispatcher()}
+	dispatcher, err := NewDispatcher()
+	if err != nil {
+		slog.Error("Error creating dispatcher", "err", err)
+		panic(err)
+	}
+	b := &bot{dispatcher: dispatcher, tent: NewTentClient()}
+	b.board = NewStatusBoard(b)
+	b.lifecycle = NewLifecycle(b.dispatcher, b.tent, b.board.Poke)
 	s, err := discordgo.New("Bot " + os.Getenv("BOT_TOKEN"))
 	if err != nil {
 		slog.Error("Error creating Discord session", "err", err)
@@ -48,7 +86,14 @@ func (b *bot) Run() {
 		slog.Error("Error opening connection", "err", err)
 		panic(err)
 	}
-	b.setCommands()
+	err = b.setCommands()
+	if err != nil {
+		slog.Error("Error registering commands", "err", err)
+		panic(err)
+	}
+	go b.board.Run()
+	go serveMetrics()
+	go b.serveCallbacks()
 
 	defer b.session.Close()
 	stop := make(chan os.Signal, 1)
@@ -57,20 +102,6 @@ func (b *bot) Run() {
 	<-stop
 }
 
-func (b *bot) setCommands() {
-	uid := b.session.State.User.ID
-	registeredCommands, _ := b.session.ApplicationCommands(uid, b.ids.guild)
-	for _, v := range registeredCommands {
-		b.session.ApplicationCommandDelete(uid, b.ids.guild, v.ID)
-	}
-	applicationCommand := &discordgo.ApplicationCommand{
-		Name:        "factorio",
-		Description: "Start the Factorio server",
-	}
-	b.session.ApplicationCommandCreate(uid, b.ids.dm, applicationCommand)
-	b.session.ApplicationCommandCreate(uid, b.ids.channel, applicationCommand)
-}
-
 func (b *bot) onReady(s *discordgo.Session, r *discordgo.Ready) {
 	slog.Info("Bot is up as", "name", s.State.User.Username, "discriminator", s.State.User.Discriminator)
 }
@@ -80,11 +111,44 @@ func (b *bot) onInteractionGo(s *discordgo.Session, i *discordgo.InteractionCrea
 }
 
 func (b *bot) onInteraction(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	commandData := i.ApplicationCommandData()
-	slog.Debug("Interaction received...", "command", commandData)
-	if commandData.Name == "factorio" {
-		b.onCommandFactorio(s, i)
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		commandData := i.ApplicationCommandData()
+		slog.Debug("Interaction received...", "command", commandData)
+		metrics.Add("tower_commands_total", 1, "command", commandData.Name, "action", commandAction(commandData))
+		if commandData.Name == "factorio" {
+			b.onCommandFactorio(s, i)
+		}
+	case discordgo.InteractionMessageComponent:
+		componentData := i.MessageComponentData()
+		slog.Debug("Component interaction received...", "component", componentData)
+		b.onComponent(i, componentData.CustomID)
+	}
+}
+
+func (b *bot) onComponent(i *discordgo.InteractionCreate, customID string) {
+	ir := discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredMessageUpdate}
+	b.session.InteractionRespond(i.Interaction, &ir)
+	metrics.Add("tower_buttons_total", 1, "button", customID)
+	var err error
+	switch customID {
+	case buttonStart:
+		ctx, span := share.Tracer.Start(context.Background(), "start button")
+		_, err = b.lifecycle.Launch(ctx)
+		share.EndSpan(span, err)
+	case buttonStop:
+		err = b.lifecycle.OnRunningTent(b.tent.Stop)
+	case buttonSave:
+		err = b.lifecycle.OnRunningTent(b.tent.Save)
+	default:
+		slog.Warn("Unknown component", "id", customID)
+		return
+	}
+	if err != nil {
+		slog.Error("Button failed", "id", customID, "err", err)
+		b.followupPrivate(i, userMessage(err))
 	}
+	b.board.Poke()
 }
 
 func (b *bot) onCommandFactorio(_ *discordgo.Session, i *discordgo.InteractionCreate) {
@@ -94,14 +158,42 @@ func (b *bot) onCommandFactorio(_ *discordgo.Session, i *discordgo.InteractionCr
 		return
 	}
 	b.replyLater(i)
-	b.dispatcher.LaunchFactorio()
-	if b.dispatcher.err != nil {
-		b.replyAmend(i, "Error: "+b.dispatcher.err.Error())
+	switch commandAction(i.ApplicationCommandData()) {
+	case actionLogs:
+		b.onCommandLogs(i)
+		return
+	case actionSave:
+		b.onCommandSave(i)
+		return
+	}
+	ctx, span := share.Tracer.Start(context.Background(), "/factorio")
+	ip, err := b.lifecycle.Launch(ctx)
+	if err != nil {
+		slog.Error("Launch failed", "err", err)
+		b.replyAmend(i, userMessage(err))
 	} else {
-		msg := fmt.Sprintf("Factorio server starting at `%s` (`%s`)",
-			os.Getenv("ROUTE53_FQDN"), *b.dispatcher.ip)
-		b.replyAmend(i, msg)
+		b.followBoot(i, ip)
 	}
+	share.EndSpan(span, err)
+}
+
+// onCommandSave saves the game and replies once the save is safely in S3.
+func (b *bot) onCommandSave(i *discordgo.InteractionCreate) {
+	var result *share.SaveResult
+	err := b.lifecycle.OnRunningTent(func(ip string) error {
+		var err error
+		result, err = b.tent.SaveAndWait(ip)
+		return err
+	})
+	if err == nil && result.Error != "" {
+		err = errors.New(result.Error)
+	}
+	if err != nil {
+		slog.Error("Save failed", "err", err)
+		b.replyAmend(i, userMessage(err))
+		return
+	}
+	b.replyAmend(i, fmt.Sprintf("Saved `%s` (%.1f MB) in %s.", result.File, float64(result.Size)/1e6, result.Duration.Round(100*time.Millisecond)))
 }
 
 func (b *bot) replyQuick(i *discordgo.InteractionCreate, content string) {
@@ -122,3 +214,10 @@ func (b *bot) replyLater(i *discordgo.InteractionCreate) {
 func (b *bot) replyAmend(i *discordgo.InteractionCreate, content string) {
 	b.session.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content})
 }
+
+func (b *bot) followupPrivate(i *discordgo.InteractionCreate, content string) {
+	b.session.FollowupMessageCreate(i.Interaction, false, &discordgo.WebhookParams{
+		Content: content,
+		Flags:   discordgo.MessageFlagsEphemeral,
+	})
+}
@@ -0,0 +1,52 @@
+package tower
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"mansionTent/share"
+	"net/http"
+	"os"
+)
+
+// callbackURL is where the tent should report its state changes, or "" if CALLBACK_PORT isn't set
+// and the tower only finds out by polling.
+func callbackURL() (string, error) {
+	port := os.Getenv("CALLBACK_PORT")
+	if port == "" {
+		return "", nil
+	}
+	tower, err := towerAddress()
+	if err != nil {
+		return "", err
+	}
+	return "http://" + tower + ":" + port + "/tent/status", nil
+}
+
+// serveCallbacks takes status reports from the tent on CALLBACK_PORT, if it's set.
+func (b *bot) serveCallbacks() {
+	port := os.Getenv("CALLBACK_PORT")
+	if port == "" {
+		return
+	}
+	expected := []byte("Bearer " + share.ControlToken())
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /tent/status", func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		status := &share.Status{}
+		err := json.NewDecoder(r.Body).Decode(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.lifecycle.Report(status)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	slog.Info("Callbacks listening", "port", port)
+	err := http.ListenAndServe(":"+port, mux)
+	slog.Error("Callback port closed", "err", err)
+}
@@ -0,0 +1,124 @@
+package tower
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// globalScope is the guild ID the Discord API uses for application-wide commands.
+const globalScope = ""
+
+// The choices of the /factorio action option; leaving it out means start.
+const (
+	actionStart = "start"
+	actionLogs  = "logs"
+	actionSave  = "save"
+)
+
+func factorioCommand(inDMs bool) *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		Name:         "factorio",
+		Description:  "Start the Factorio server",
+		DMPermission: &inDMs,
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "action",
+			Description: "What to do instead of starting the server",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "Start the server", Value: actionStart},
+				{Name: "Save the game now", Value: actionSave},
+				{Name: "Show the server logs", Value: actionLogs},
+			},
+		}},
+	}
+}
+
+// commandAction is the action option of a /factorio command.
+func commandAction(data discordgo.ApplicationCommandInteractionData) string {
+	for _, option := range data.Options {
+		if option.Name == "action" {
+			return option.StringValue()
+		}
+	}
+	return actionStart
+}
+
+// commandScopes declares every command the bot should have, keyed by scope.
+// Scopes that map to an empty list are cleaned up, so nothing stale survives a config change.
+// Commands usable in DMs must be global, and a guild copy would show up twice, so it's one or the other.
+func (b *bot) commandScopes() map[string][]*discordgo.ApplicationCommand {
+	scopes := map[string][]*discordgo.ApplicationCommand{
+		globalScope: {},
+	}
+	if b.ids.dm != "" {
+		scopes[globalScope] = append(scopes[globalScope], factorioCommand(true))
+		if b.ids.guild != "" {
+			scopes[b.ids.guild] = []*discordgo.ApplicationCommand{}
+		}
+	} else if b.ids.guild != "" {
+		scopes[b.ids.guild] = []*discordgo.ApplicationCommand{factorioCommand(false)}
+	}
+	return scopes
+}
+
+func (b *bot) setCommands() error {
+	uid := b.session.State.User.ID
+	for scope, wanted := range b.commandScopes() {
+		registered, err := b.session.ApplicationCommands(uid, scope)
+		if err != nil {
+			return fmt.Errorf("listing commands in scope %q: %w", scope, err)
+		}
+		if sameCommands(registered, wanted) {
+			slog.Debug("Commands already up to date", "scope", scope, "count", len(wanted))
+			continue
+		}
+		_, err = b.session.ApplicationCommandBulkOverwrite(uid, scope, wanted)
+		if err != nil {
+			return fmt.Errorf("overwriting commands in scope %q: %w", scope, err)
+		}
+		slog.Info("Commands updated", "scope", scope, "count", len(wanted))
+	}
+	return nil
+}
+
+// commandShape is the part of a command we declare; everything else is filled in by Discord.
+type commandShape struct {
+	Name         string
+	Description  string
+	Options      []*discordgo.ApplicationCommandOption
+	DMPermission bool
+}
+
+func shapeOf(command *discordgo.ApplicationCommand) commandShape {
+	shape := commandShape{
+		Name:         command.Name,
+		Description:  command.Description,
+		Options:      command.Options,
+		DMPermission: true, // Discord's default when unset
+	}
+	if command.DMPermission != nil {
+		shape.DMPermission = *command.DMPermission
+	}
+	return shape
+}
+
+func sameCommands(registered, wanted []*discordgo.ApplicationCommand) bool {
+	if len(registered) != len(wanted) {
+		return false
+	}
+	shapes := make(map[string]string, len(registered))
+	for _, command := range registered {
+		encoded, _ := json.Marshal(shapeOf(command))
+		shapes[command.Name] = string(encoded)
+	}
+	for _, command := range wanted {
+		encoded, _ := json.Marshal(shapeOf(command))
+		if shapes[command.Name] != string(encoded) {
+			return false
+		}
+	}
+	return true
+}
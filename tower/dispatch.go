@@ -1,36 +1,44 @@
 package tower
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"mansionTent/share"
+	"maps"
 	"net/url"
 	"os"
-	"path/filepath"
-	"runtime"
-	"runtime/debug"
 	"strings"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/joho/godotenv"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
 type dispatcher struct {
-	ec2      *ec2.EC2
-	r53      *route53.Route53
-	s3       *s3.S3
-	s3folder url.URL
-	userdata *string
-	trying   sync.Mutex
-	err      error
-	instance *string
-	ip       *string
+	ec2       *ec2.EC2
+	dns       dnsProvider
+	s3        *s3.S3
+	ssm       *ssm.SSM
+	secrets   *secretsmanager.SecretsManager
+	s3folder  url.URL
+	bootstrap map[string]string
+	arch      architecture
+	trying    sync.Mutex
+}
+
+// launchedServer is where a freshly launched instance can be reached.
+type launchedServer struct {
+	instance string
+	ip       string
+	ipv6     string // empty without IPv6
 }
 
 var (
@@ -42,10 +50,32 @@ var (
 )
 
 func RunDispatcher() {
-	NewDispatcher().ConsoleLaunch()
+	l, err := NewDispatcher()
+	if err != nil {
+		slog.Error("Error creating dispatcher", "err", err)
+		panic(err)
+	}
+	l.ConsoleLaunch()
 }
 
-func NewDispatcher() *dispatcher {
+func NewDispatcher() (*dispatcher, error) {
+	l, err := newDispatcher()
+	if err != nil {
+		return nil, err
+	}
+	l.bootstrap, err = l.publishConfig()
+	if err != nil {
+		return nil, err
+	}
+	err = l.uploadExecutables()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// newDispatcher sets up the clients without publishing or uploading anything.
+func newDispatcher() (*dispatcher, error) {
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 		Config:            aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))},
@@ -54,89 +84,93 @@ func NewDispatcher() *dispatcher {
 		SharedConfigState: session.SharedConfigEnable,
 		Config:            aws.Config{Region: aws.String(os.Getenv("AWS_REGION_S3"))},
 	}))
-	sessUsE1 := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Config:            aws.Config{Region: aws.String("us-east-1")},
-	}))
 	l := &dispatcher{
-		ec2: ec2.New(sess),
-		r53: route53.New(sessUsE1),
-		s3:  s3.New(sess3),
+		ec2:     ec2.New(sess),
+		dns:     NewDnsProvider(),
+		s3:      s3.New(sess3),
+		ssm:     ssm.New(sess),
+		secrets: secretsmanager.New(sess),
 	}
 
 	parsed, err := url.Parse(os.Getenv("S3_FOLDER_URL"))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("parsing S3_FOLDER_URL: %w", err)
 	}
 	parsed.Path = strings.Trim(parsed.Path, "/")
 	l.s3folder = *parsed
 	l.s3folder.Path = strings.Trim(l.s3folder.Path, "/")
-	l.userdata = l.generateUserData()
-
-	l.uploadExecutable()
-	return l
+	l.arch, err = l.instanceArchitecture()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
 }
 
 func (l *dispatcher) ConsoleLaunch() {
-	l.LaunchFactorio()
-	if l.err != nil {
-		slog.Error("Launcher error", "err", l.err)
+	ctx, span := share.Tracer.Start(context.Background(), "dispatch")
+	server, err := l.LaunchFactorio(ctx)
+	share.EndSpan(span, err)
+	if err != nil {
+		slog.Error("Launcher error", "err", err)
 	} else {
-		slog.Info("Launched instance", "hostname", os.Getenv("ROUTE53_FQDN"), "ip", *l.ip)
+		slog.Info("Launched instance", "hostname", os.Getenv("ROUTE53_FQDN"), "ip", server.ip)
 	}
 }
 
-func (l *dispatcher) uploadExecutable() {
-	executable, err := os.Executable()
-	if err != nil {
-		panic(err)
+func (l *dispatcher) LaunchFactorio(ctx context.Context) (launchedServer, error) {
+	if !l.trying.TryLock() {
+		return launchedServer{}, ErrAlreadyRunning
 	}
-	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
-		// change the extension to .x64
-		extension := filepath.Ext(executable)
-		pos := len(executable) - len(extension)
-		executable = executable[:pos] + ".x64"
+	defer l.trying.Unlock()
+	err := traced(ctx, "check running", func(context.Context) error {
+		return l.checkIfAlreadyRunning()
+	})
+	if err != nil {
+		return launchedServer{}, err
 	}
-	file, err := os.Open(executable)
+	var server launchedServer
+	err = traced(ctx, "create instance", func(ctx context.Context) error {
+		server, err = l.createInstance(ctx)
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return launchedServer{}, err
 	}
-	err = l.UploadToS3("mt.x64", file)
+	err = traced(ctx, "update DNS", func(context.Context) error {
+		return l.updateDnsRecords(server)
+	})
 	if err != nil {
-		panic(err)
+		return launchedServer{}, err
 	}
-	slog.Info("Uploaded", "file", file.Name())
+	return server, nil
 }
 
-func (l *dispatcher) LaunchFactorio() {
-	defer func() {
-		if recover() != nil {
-			debug.PrintStack()
-		}
-	}()
-	if !l.trying.TryLock() {
-		panic(ErrAlreadyRunning)
-	}
-	l.checkIfAlreadyRunning()
-	l.createInstance()
-	l.updateDnsRecord()
-	l.trying.Unlock()
+// traced runs one launch step in its own span.
+func traced(ctx context.Context, name string, step func(context.Context) error) error {
+	ctx, span := share.Tracer.Start(ctx, name)
+	err := step(ctx)
+	share.EndSpan(span, err)
+	return err
 }
 
-func (l *dispatcher) getLatestAmazonLinuxAMI() *ec2.Image {
+func (l *dispatcher) getLatestAmazonLinuxAMI(ctx context.Context) (*ec2.Image, error) {
 	params := &ec2.DescribeImagesInput{Filters: []*ec2.Filter{{
 		Name:   aws.String("name"),
-		Values: []*string{aws.String("al2023-ami-2*-x86_64")},
+		Values: []*string{aws.String("al2023-ami-2*-" + l.arch.ec2)},
 	}, {
 		Name:   aws.String("owner-id"),
 		Values: []*string{aws.String("137112412989")}, // Amazon
 	}}}
-	resp, err := l.ec2.DescribeImages(params)
+	var resp *ec2.DescribeImagesOutput
+	err := traced(ctx, "DescribeImages", func(ctx context.Context) (err error) {
+		resp, err = l.ec2.DescribeImagesWithContext(ctx, params)
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("describing images: %w", err)
 	}
 	if len(resp.Images) == 0 {
-		panic(ErrNoAMI)
+		return nil, ErrNoAMI
 	}
 	// find the latest image
 	latestAmi := resp.Images[0]
@@ -149,28 +183,28 @@ func (l *dispatcher) getLatestAmazonLinuxAMI() *ec2.Image {
 		"id", *latestAmi.ImageId,
 		"name", *latestAmi.Name,
 		"date", *latestAmi.CreationDate)
-	return latestAmi
+	return latestAmi, nil
 }
 
-func (l *dispatcher) generateUserData() *string {
-	url := os.Getenv("S3_FOLDER_URL")
-	values, err := godotenv.Read("mt.env")
+// generateUserData renders the user-data for one launch, carrying on its trace in the tent.
+func (l *dispatcher) generateUserData(ctx context.Context) (*string, error) {
+	env := maps.Clone(l.bootstrap)
+	if traceparent := share.Traceparent(ctx); traceparent != "" {
+		env["TRACEPARENT"] = traceparent
+	}
+	callback, err := callbackURL()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if callback != "" {
+		env["MT_CALLBACK_URL"] = callback
 	}
-	marshalled, err := godotenv.Marshal(values)
+	rendered, err := l.renderUserData(env)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	lines := "#!/bin/bash\n" +
-		"mkdir -p /opt/mansionTent\n" +
-		"cat > /opt/mansionTent/mt.env <<EOF\n" +
-		marshalled + "\nEOF\n" +
-		"aws s3 cp " + url + "/mt.x64 /opt/mansionTent/mt.x64\n" +
-		"chmod +x /opt/mansionTent/mt.x64\n" +
-		"sudo -iu ec2-user screen -dm /opt/mansionTent/mt.x64 launch\n"
-	encoded := base64.StdEncoding.EncodeToString([]byte(lines))
-	return aws.String(encoded)
+	encoded := base64.StdEncoding.EncodeToString([]byte(rendered))
+	return aws.String(encoded), nil
 }
 
 func (l *dispatcher) generateTagSpecifications() []*ec2.TagSpecification {
@@ -184,13 +218,21 @@ func (l *dispatcher) generateTagSpecifications() []*ec2.TagSpecification {
 	}
 }
 
-func (l *dispatcher) createInstance() {
+func (l *dispatcher) createInstance(ctx context.Context) (launchedServer, error) {
+	ami, err := l.getLatestAmazonLinuxAMI(ctx)
+	if err != nil {
+		return launchedServer{}, err
+	}
+	userdata, err := l.generateUserData(ctx)
+	if err != nil {
+		return launchedServer{}, err
+	}
 	params := &ec2.RunInstancesInput{
-		ImageId:      l.getLatestAmazonLinuxAMI().ImageId,
+		ImageId:      ami.ImageId,
 		InstanceType: aws.String(os.Getenv("EC2_INSTANCE_TYPE")),
 		MinCount:     aws.Int64(1),
 		MaxCount:     aws.Int64(1),
-		UserData:     l.userdata,
+		UserData:     userdata,
 		DryRun:       aws.Bool(false),
 		IamInstanceProfile: &ec2.IamInstanceProfileSpecification{
 			Name: aws.String(os.Getenv("EC2_IAM_ROLE")),
@@ -202,91 +244,133 @@ func (l *dispatcher) createInstance() {
 	if ec2KeyPair != "" {
 		params.KeyName = aws.String(ec2KeyPair)
 	}
-	reservation, err := l.ec2.RunInstances(params)
+	var group string
+	err = traced(ctx, "security group", func(context.Context) error {
+		group, err = l.ensureSecurityGroup()
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return launchedServer{}, err
+	}
+	if subnet := os.Getenv("EC2_SUBNET_ID"); subnet != "" {
+		// a custom subnet may not hand out public IPs on its own
+		params.NetworkInterfaces = []*ec2.InstanceNetworkInterfaceSpecification{{
+			DeviceIndex:              aws.Int64(0),
+			SubnetId:                 aws.String(subnet),
+			Groups:                   []*string{aws.String(group)},
+			AssociatePublicIpAddress: aws.Bool(true),
+		}}
+	} else {
+		params.SecurityGroupIds = []*string{aws.String(group)}
+	}
+	var volume *ec2.Volume
+	if dataVolumeSize() > 0 {
+		err = traced(ctx, "data volume", func(context.Context) error {
+			volume, err = l.findOrCreateDataVolume()
+			return err
+		})
+		if err != nil {
+			return launchedServer{}, err
+		}
+		params.Placement = &ec2.Placement{AvailabilityZone: volume.AvailabilityZone}
+	}
+	var reservation *ec2.Reservation
+	err = traced(ctx, "RunInstances", func(ctx context.Context) error {
+		reservation, err = l.ec2.RunInstancesWithContext(ctx, params)
+		return err
+	})
+	if err != nil {
+		return launchedServer{}, fmt.Errorf("running instance: %w", err)
 	}
 	instance := reservation.Instances[0]
 	slog.Debug("Launched",
 		"instance", *instance.InstanceId,
 		"ami", *instance.ImageId,
 		"type", *instance.InstanceType,
-		"key", *instance.KeyName,
+		"key", aws.StringValue(instance.KeyName),
 		"state", *instance.State.Name)
-	l.instance = instance.InstanceId
-	l.ip = l.checkForIp()
+	server := launchedServer{instance: aws.StringValue(instance.InstanceId)}
+	server.ip, server.ipv6, err = l.checkForIp(ctx, server.instance)
+	if err != nil {
+		return launchedServer{}, err
+	}
+	if useElasticIP() {
+		err = traced(ctx, "elastic IP", func(context.Context) error {
+			server.ip, err = l.associateElasticIP(server.instance)
+			return err
+		})
+		if err != nil {
+			return launchedServer{}, err
+		}
+	}
+	if volume != nil {
+		err = traced(ctx, "attach volume", func(context.Context) error {
+			return l.attachDataVolume(volume, server.instance)
+		})
+		if err != nil {
+			return launchedServer{}, err
+		}
+	}
+	return server, nil
+}
+
+func (l *dispatcher) checkIfAlreadyRunning() error {
+	instance, err := l.FindRunning()
+	if err != nil {
+		return err
+	}
+	if instance != nil {
+		return fmt.Errorf("%w: %s", ErrAlreadyRunning, *instance.InstanceId)
+	}
+	return nil
 }
 
-func (l *dispatcher) checkIfAlreadyRunning() {
+// FindRunning returns the pending or running tent instance, or nil if there is none.
+func (l *dispatcher) FindRunning() (*ec2.Instance, error) {
 	params := &ec2.DescribeInstancesInput{
 		Filters: []*ec2.Filter{{
 			Name:   aws.String("tag:Name"),
 			Values: []*string{aws.String(os.Getenv("EC2_NAME_TAG"))},
 		}, {
 			Name:   aws.String("instance-state-name"),
-			Values: []*string{aws.String("running")},
+			Values: []*string{aws.String("pending"), aws.String("running")},
 		}},
 	}
 	resp, err := l.ec2.DescribeInstances(params)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("describing instances: %w", err)
 	}
 	for _, reservation := range resp.Reservations {
 		if len(reservation.Instances) > 0 {
-			panic(ErrAlreadyRunning)
+			return reservation.Instances[0], nil
 		}
 	}
+	return nil, nil
 }
 
-func (l *dispatcher) checkForIp() *string {
+func (l *dispatcher) checkForIp(ctx context.Context, instanceID string) (ip, ipv6 string, err error) {
 	describe := &ec2.DescribeInstancesInput{
-		InstanceIds: []*string{l.instance},
+		InstanceIds: []*string{aws.String(instanceID)},
 	}
-	err := l.ec2.WaitUntilInstanceRunning(describe)
+	err = traced(ctx, "WaitUntilInstanceRunning", func(ctx context.Context) error {
+		return l.ec2.WaitUntilInstanceRunningWithContext(ctx, describe)
+	})
 	if err != nil {
-		panic(err)
+		return "", "", fmt.Errorf("waiting for instance %s: %w", instanceID, err)
 	}
-	slog.Debug("Instance is running", "id", *l.instance)
-	description, err := l.ec2.DescribeInstances(describe)
+	slog.Debug("Instance is running", "id", instanceID)
+	description, err := l.ec2.DescribeInstancesWithContext(ctx, describe)
 	if err != nil {
-		panic(err)
+		return "", "", fmt.Errorf("describing instance %s: %w", instanceID, err)
 	}
 	if len(description.Reservations) == 0 || len(description.Reservations[0].Instances) == 0 {
-		panic(ErrInstanceNotFound)
+		return "", "", fmt.Errorf("%w: %s", ErrInstanceNotFound, instanceID)
 	}
 	instance := description.Reservations[0].Instances[0]
-	if instance.PublicIpAddress != nil {
-		return instance.PublicIpAddress
-	}
-	panic(ErrInstanceHasNoIP)
-}
-
-func (l *dispatcher) updateDnsRecord() {
-	zoneId := os.Getenv("ROUTE53_ZONE_ID")
-	if zoneId == "" || l.ip == nil {
-		return
-	}
-	params := &route53.ChangeResourceRecordSetsInput{
-		ChangeBatch: &route53.ChangeBatch{
-			Changes: []*route53.Change{{
-				Action: aws.String("UPSERT"),
-				ResourceRecordSet: &route53.ResourceRecordSet{
-					Name: aws.String(os.Getenv("ROUTE53_FQDN")),
-					ResourceRecords: []*route53.ResourceRecord{{
-						Value: l.ip,
-					}},
-					TTL:  aws.Int64(60),
-					Type: aws.String("A"),
-				},
-			}},
-			Comment: aws.String("Update A record for Factorio server"),
-		},
-		HostedZoneId: aws.String(zoneId),
-	}
-	_, err := l.r53.ChangeResourceRecordSets(params)
-	if err != nil {
-		panic(err)
+	if instance.PublicIpAddress == nil {
+		return "", "", fmt.Errorf("%w: %s", ErrInstanceHasNoIP, instanceID)
 	}
+	return *instance.PublicIpAddress, aws.StringValue(instance.Ipv6Address), nil
 }
 
 func (l *dispatcher) UploadToS3(name string, file io.ReadSeeker) error {
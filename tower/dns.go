@@ -0,0 +1,298 @@
+package tower
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/miekg/dns"
+)
+
+const dnsTTL = 60
+
+// dnsProvider points one name at the server. recordType is "A" or "AAAA".
+type dnsProvider interface {
+	Name() string
+	Set(recordType, value string) error
+	Remove(recordType string) error
+}
+
+// NewDnsProvider picks a provider from DNS_PROVIDER. Route53 stays the default for existing configs.
+func NewDnsProvider() dnsProvider {
+	fqdn := strings.TrimSuffix(os.Getenv("ROUTE53_FQDN"), ".")
+	provider := strings.ToLower(os.Getenv("DNS_PROVIDER"))
+	if provider == "" && os.Getenv("ROUTE53_ZONE_ID") != "" {
+		provider = "route53"
+	}
+	switch provider {
+	case "":
+		return nil
+	case "route53":
+		sessUsE1 := session.Must(session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+			Config:            aws.Config{Region: aws.String("us-east-1")},
+		}))
+		return &route53Provider{
+			r53:    route53.New(sessUsE1),
+			zoneId: os.Getenv("ROUTE53_ZONE_ID"),
+			fqdn:   fqdn,
+		}
+	case "cloudflare":
+		return &cloudflareProvider{
+			http:   &http.Client{Timeout: 15 * time.Second},
+			token:  os.Getenv("CLOUDFLARE_API_TOKEN"),
+			zoneId: os.Getenv("CLOUDFLARE_ZONE_ID"),
+			fqdn:   fqdn,
+		}
+	case "rfc2136":
+		algorithm := os.Getenv("RFC2136_TSIG_ALGORITHM")
+		if algorithm == "" {
+			algorithm = dns.HmacSHA256
+		}
+		return &rfc2136Provider{
+			server:    os.Getenv("RFC2136_SERVER"),
+			zone:      dns.Fqdn(os.Getenv("RFC2136_ZONE")),
+			fqdn:      dns.Fqdn(fqdn),
+			keyName:   dns.Fqdn(os.Getenv("RFC2136_TSIG_NAME")),
+			secret:    os.Getenv("RFC2136_TSIG_SECRET"),
+			algorithm: dns.Fqdn(algorithm),
+		}
+	default:
+		slog.Error("Unknown DNS provider, DNS updates disabled", "provider", provider)
+		return nil
+	}
+}
+
+// updateDnsRecords points the name at a launched server, including AAAA when it has IPv6.
+func (l *dispatcher) updateDnsRecords(server launchedServer) error {
+	if l.dns == nil {
+		return nil
+	}
+	err := l.dns.Set("A", server.ip)
+	if err != nil {
+		return fmt.Errorf("%s: setting A record: %w", l.dns.Name(), err)
+	}
+	if server.ipv6 != "" {
+		err = l.dns.Set("AAAA", server.ipv6)
+	} else {
+		err = l.dns.Remove("AAAA")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: setting AAAA record: %w", l.dns.Name(), err)
+	}
+	slog.Debug("DNS updated", "provider", l.dns.Name(), "ip", server.ip)
+	return nil
+}
+
+// ClearDnsRecords is called once the server is gone, so nobody connects to an IP that now belongs to someone else.
+// With DNS_PLACEHOLDER_IP set, the name points there instead of disappearing.
+// An elastic IP stays ours between launches, so its A record is left alone; only the per-instance AAAA goes.
+func (l *dispatcher) ClearDnsRecords() error {
+	if l.dns == nil {
+		return nil
+	}
+	var err error
+	switch placeholder := os.Getenv("DNS_PLACEHOLDER_IP"); {
+	case useElasticIP():
+		// the next launch gets the same address
+	case placeholder != "":
+		err = l.dns.Set("A", placeholder)
+	default:
+		err = l.dns.Remove("A")
+	}
+	if err == nil {
+		err = l.dns.Remove("AAAA")
+	}
+	if err != nil {
+		return fmt.Errorf("%s: clearing records: %w", l.dns.Name(), err)
+	}
+	slog.Info("DNS cleared", "provider", l.dns.Name())
+	return nil
+}
+
+type route53Provider struct {
+	r53    *route53.Route53
+	zoneId string
+	fqdn   string
+}
+
+func (p *route53Provider) Name() string { return "route53" }
+
+func (p *route53Provider) change(action string, record *route53.ResourceRecordSet) error {
+	_, err := p.r53.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: []*route53.Change{{
+				Action:            aws.String(action),
+				ResourceRecordSet: record,
+			}},
+			Comment: aws.String("Update record for Factorio server"),
+		},
+		HostedZoneId: aws.String(p.zoneId),
+	})
+	return err
+}
+
+func (p *route53Provider) Set(recordType, value string) error {
+	return p.change("UPSERT", &route53.ResourceRecordSet{
+		Name:            aws.String(p.fqdn),
+		ResourceRecords: []*route53.ResourceRecord{{Value: aws.String(value)}},
+		TTL:             aws.Int64(dnsTTL),
+		Type:            aws.String(recordType),
+	})
+}
+
+func (p *route53Provider) Remove(recordType string) error {
+	// Route53 only deletes a record given its exact current contents
+	resp, err := p.r53.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(p.zoneId),
+		StartRecordName: aws.String(p.fqdn),
+		StartRecordType: aws.String(recordType),
+		MaxItems:        aws.String("1"),
+	})
+	if err != nil {
+		return err
+	}
+	for _, record := range resp.ResourceRecordSets {
+		if strings.TrimSuffix(*record.Name, ".") == p.fqdn && *record.Type == recordType {
+			return p.change("DELETE", record)
+		}
+	}
+	return nil
+}
+
+type cloudflareProvider struct {
+	http   *http.Client
+	token  string
+	zoneId string
+	fqdn   string
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+func (p *cloudflareProvider) Name() string { return "cloudflare" }
+
+func (p *cloudflareProvider) call(method, path string, payload any, result any) error {
+	var body bytes.Buffer
+	if payload != nil {
+		json.NewEncoder(&body).Encode(payload)
+	}
+	request, err := http.NewRequest(method, "https://api.cloudflare.com/client/v4/zones/"+p.zoneId+path, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+p.token)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := p.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var envelope struct {
+		Success bool            `json:"success"`
+		Errors  []any           `json:"errors"`
+		Result  json.RawMessage `json:"result"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&envelope)
+	if err != nil {
+		return fmt.Errorf("%s: %w", response.Status, err)
+	}
+	if !envelope.Success {
+		return fmt.Errorf("%s: %v", response.Status, envelope.Errors)
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
+
+func (p *cloudflareProvider) find(recordType string) (*cloudflareRecord, error) {
+	var records []cloudflareRecord
+	err := p.call(http.MethodGet, "/dns_records?type="+recordType+"&name="+p.fqdn, nil, &records)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[0], nil
+}
+
+func (p *cloudflareProvider) Set(recordType, value string) error {
+	existing, err := p.find(recordType)
+	if err != nil {
+		return err
+	}
+	record := cloudflareRecord{Type: recordType, Name: p.fqdn, Content: value, TTL: dnsTTL}
+	if existing == nil {
+		return p.call(http.MethodPost, "/dns_records", record, nil)
+	}
+	return p.call(http.MethodPut, "/dns_records/"+existing.ID, record, nil)
+}
+
+func (p *cloudflareProvider) Remove(recordType string) error {
+	existing, err := p.find(recordType)
+	if err != nil || existing == nil {
+		return err
+	}
+	return p.call(http.MethodDelete, "/dns_records/"+existing.ID, nil, nil)
+}
+
+// rfc2136Provider sends TSIG-signed dynamic updates, e.g. to BIND or Knot.
+type rfc2136Provider struct {
+	server    string
+	zone      string
+	fqdn      string
+	keyName   string
+	secret    string
+	algorithm string
+}
+
+func (p *rfc2136Provider) Name() string { return "rfc2136" }
+
+func (p *rfc2136Provider) send(message *dns.Msg) error {
+	client := &dns.Client{Net: "tcp", Timeout: 15 * time.Second}
+	if p.keyName != "." && p.secret != "" {
+		client.TsigSecret = map[string]string{p.keyName: p.secret}
+		message.SetTsig(p.keyName, p.algorithm, 300, time.Now().Unix())
+	}
+	reply, _, err := client.Exchange(message, p.server)
+	if err != nil {
+		return err
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return errors.New(dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) Set(recordType, value string) error {
+	record, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", p.fqdn, dnsTTL, recordType, value))
+	if err != nil {
+		return err
+	}
+	message := new(dns.Msg)
+	message.SetUpdate(p.zone)
+	message.RemoveRRset([]dns.RR{record})
+	message.Insert([]dns.RR{record})
+	return p.send(message)
+}
+
+func (p *rfc2136Provider) Remove(recordType string) error {
+	header := dns.RR_Header{Name: p.fqdn, Rrtype: dns.StringToType[recordType], Class: dns.ClassINET}
+	message := new(dns.Msg)
+	message.SetUpdate(p.zone)
+	message.RemoveRRset([]dns.RR{&dns.ANY{Hdr: header}})
+	return p.send(message)
+}
@@ -0,0 +1,144 @@
+package tower
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testZone    = "example.com."
+	testFqdn    = "factorio.example.com."
+	testKeyName = "tower-key."
+	testSecret  = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+)
+
+// fakeDnsServer applies TSIG-signed dynamic updates for one zone to an in-memory record set.
+type fakeDnsServer struct {
+	mutex   sync.Mutex
+	records map[uint16]string
+	address string
+}
+
+func startFakeDnsServer(t *testing.T) *fakeDnsServer {
+	t.Helper()
+	fake := &fakeDnsServer{records: make(map[uint16]string)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.address = listener.Addr().String()
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          listener,
+		Handler:           fake,
+		TsigSecret:        map[string]string{testKeyName: testSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// the default accept func turns away updates as not implemented
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return fake
+}
+
+func (f *fakeDnsServer) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	tsig := request.IsTsig()
+	switch {
+	case tsig == nil || w.TsigStatus() != nil:
+		reply.Rcode = dns.RcodeNotAuth
+	case request.Opcode != dns.OpcodeUpdate || request.Question[0].Name != testZone:
+		reply.Rcode = dns.RcodeRefused
+	default:
+		f.mutex.Lock()
+		for _, record := range request.Ns {
+			header := record.Header()
+			if header.Name != testFqdn {
+				continue
+			}
+			// deleting an RRset is an empty record of the type with class ANY
+			if header.Class == dns.ClassANY {
+				delete(f.records, header.Rrtype)
+				continue
+			}
+			switch value := record.(type) {
+			case *dns.A:
+				f.records[dns.TypeA] = value.A.String()
+			case *dns.AAAA:
+				f.records[dns.TypeAAAA] = value.AAAA.String()
+			}
+		}
+		f.mutex.Unlock()
+	}
+	if tsig != nil {
+		reply.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(reply)
+}
+
+func (f *fakeDnsServer) record(recordType uint16) (string, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	value, ok := f.records[recordType]
+	return value, ok
+}
+
+func newTestRfc2136Provider(server, secret string) *rfc2136Provider {
+	return &rfc2136Provider{
+		server:    server,
+		zone:      testZone,
+		fqdn:      testFqdn,
+		keyName:   testKeyName,
+		secret:    secret,
+		algorithm: dns.HmacSHA256,
+	}
+}
+
+func TestRfc2136SetAndRemove(t *testing.T) {
+	fake := startFakeDnsServer(t)
+	provider := newTestRfc2136Provider(fake.address, testSecret)
+	steps := []struct {
+		name       string
+		run        func() error
+		recordType uint16
+		want       string // "" means the record should be gone
+	}{
+		{"set A", func() error { return provider.Set("A", "203.0.113.7") }, dns.TypeA, "203.0.113.7"},
+		{"replace A", func() error { return provider.Set("A", "203.0.113.8") }, dns.TypeA, "203.0.113.8"},
+		{"set AAAA", func() error { return provider.Set("AAAA", "2001:db8::1") }, dns.TypeAAAA, "2001:db8::1"},
+		{"remove AAAA", func() error { return provider.Remove("AAAA") }, dns.TypeAAAA, ""},
+		{"A survives removing AAAA", func() error { return nil }, dns.TypeA, "203.0.113.8"},
+		{"remove A", func() error { return provider.Remove("A") }, dns.TypeA, ""},
+		{"remove missing A", func() error { return provider.Remove("A") }, dns.TypeA, ""},
+	}
+	for _, step := range steps {
+		err := step.run()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		got, ok := fake.record(step.recordType)
+		if step.want == "" && ok {
+			t.Errorf("%s: record is still %s", step.name, got)
+		} else if step.want != "" && got != step.want {
+			t.Errorf("%s: record is %q, want %q", step.name, got, step.want)
+		}
+	}
+}
+
+func TestRfc2136RejectsWrongKey(t *testing.T) {
+	fake := startFakeDnsServer(t)
+	provider := newTestRfc2136Provider(fake.address, "d3Jvbmctc2VjcmV0")
+	err := provider.Set("A", "203.0.113.7")
+	if err == nil {
+		t.Fatal("update with the wrong key succeeded")
+	}
+	if _, ok := fake.record(dns.TypeA); ok {
+		t.Error("update with the wrong key changed the record")
+	}
+}
@@ -0,0 +1,160 @@
+package tower
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestUserMessage(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{ErrAlreadyRunning, "The server is already running."},
+		{ErrNotRunning, "The server isn't running."},
+		{ErrNoAMI, "Couldn't find a machine image"},
+		{ErrNoSecurityGroup, "Couldn't set up the server's firewall."},
+		{ErrInstanceNotFound, "The server vanished right after launching."},
+		{ErrInstanceHasNoIP, "The server has no public IP."},
+		{ErrPhaseTimeout, "The server seems stuck: "},
+		{errors.New("disk on fire"), "Something went wrong: "},
+	}
+	for _, c := range cases {
+		for _, err := range []error{c.err, fmt.Errorf("launching: %w", c.err)} {
+			got := userMessage(err)
+			if !strings.HasPrefix(got, c.want) {
+				t.Errorf("userMessage(%q) = %q, want it to start with %q", err, got, c.want)
+			}
+		}
+	}
+}
+
+// fakeEC2 answers EC2 query API calls with canned XML, in order per action; the last one repeats.
+type fakeEC2 struct {
+	mutex     sync.Mutex
+	responses map[string][]string
+}
+
+const (
+	noInstances      = `<DescribeInstancesResponse><reservationSet/></DescribeInstancesResponse>`
+	runningInstance  = `<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1</instanceId><instanceState><name>running</name></instanceState><ipAddress>203.0.113.7</ipAddress></item></instancesSet></item></reservationSet></DescribeInstancesResponse>`
+	instanceWithNoIP = `<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1</instanceId><instanceState><name>running</name></instanceState></item></instancesSet></item></reservationSet></DescribeInstancesResponse>`
+	noImages         = `<DescribeImagesResponse><imagesSet/></DescribeImagesResponse>`
+	oneImage         = `<DescribeImagesResponse><imagesSet><item><imageId>ami-1</imageId><name>al2023-ami</name><creationDate>2024-01-01T00:00:00.000Z</creationDate></item></imagesSet></DescribeImagesResponse>`
+	noGroups         = `<DescribeSecurityGroupsResponse><securityGroupInfo/></DescribeSecurityGroupsResponse>`
+	oneGroup         = `<DescribeSecurityGroupsResponse><securityGroupInfo><item><groupId>sg-1</groupId></item></securityGroupInfo></DescribeSecurityGroupsResponse>`
+	launched         = `<RunInstancesResponse><instancesSet><item><instanceId>i-1</instanceId><imageId>ami-1</imageId><instanceType>c7a.large</instanceType><instanceState><name>pending</name></instanceState></item></instancesSet></RunInstancesResponse>`
+	forbidden        = `error`
+)
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := r.FormValue("Action")
+	f.mutex.Lock()
+	queue := f.responses[action]
+	response := `<Response><return>true</return></Response>`
+	if len(queue) > 0 {
+		response = queue[0]
+		if len(queue) > 1 {
+			f.responses[action] = queue[1:]
+		}
+	}
+	f.mutex.Unlock()
+	if response == forbidden {
+		w.WriteHeader(http.StatusForbidden)
+		response = `<Response><Errors><Error><Code>UnauthorizedOperation</Code><Message>not allowed</Message></Error></Errors><RequestID>1</RequestID></Response>`
+	}
+	w.Write([]byte(response))
+}
+
+func newTestDispatcher(t *testing.T, responses map[string][]string) *dispatcher {
+	t.Helper()
+	t.Setenv("EC2_NAME_TAG", "Factorio")
+	t.Setenv("EC2_VPC_ID", "vpc-1")
+	t.Setenv("TOWER_IP", "198.51.100.1")
+	server := httptest.NewServer(&fakeEC2{responses: responses})
+	t.Cleanup(server.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	return &dispatcher{
+		ec2:       ec2.New(sess),
+		arch:      archX64,
+		bootstrap: map[string]string{"LOG_LEVEL": "debug"},
+	}
+}
+
+func TestLaunchErrorsKeepTheirSentinel(t *testing.T) {
+	cases := []struct {
+		name      string
+		responses map[string][]string
+		want      error
+	}{
+		{"already running", map[string][]string{
+			"DescribeInstances": {runningInstance},
+		}, ErrAlreadyRunning},
+		{"no AMI", map[string][]string{
+			"DescribeInstances": {noInstances},
+			"DescribeImages":    {noImages},
+		}, ErrNoAMI},
+		{"no security group", map[string][]string{
+			"DescribeInstances":      {noInstances},
+			"DescribeImages":         {oneImage},
+			"DescribeSecurityGroups": {noGroups},
+			"CreateSecurityGroup":    {forbidden},
+		}, ErrNoSecurityGroup},
+		{"instance vanished", map[string][]string{
+			"DescribeInstances":      {noInstances, runningInstance, noInstances},
+			"DescribeImages":         {oneImage},
+			"DescribeSecurityGroups": {oneGroup},
+			"RunInstances":           {launched},
+		}, ErrInstanceNotFound},
+		{"no public IP", map[string][]string{
+			"DescribeInstances":      {noInstances, instanceWithNoIP},
+			"DescribeImages":         {oneImage},
+			"DescribeSecurityGroups": {oneGroup},
+			"RunInstances":           {launched},
+		}, ErrInstanceHasNoIP},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lc := NewLifecycle(newTestDispatcher(t, c.responses), NewTentClient(), nil)
+			_, err := lc.Launch(context.Background())
+			if !errors.Is(err, c.want) {
+				t.Fatalf("Launch() = %v, want it to wrap %v", err, c.want)
+			}
+			if view := lc.View(); !errors.Is(view.err, c.want) {
+				t.Errorf("view.err = %v, want it to wrap %v", view.err, c.want)
+			}
+		})
+	}
+}
+
+func TestObserveTimeoutKeepsItsSentinel(t *testing.T) {
+	t.Setenv("CONTROL_PORT", "1") // nothing listens there, so the tent looks unreachable
+	d := newTestDispatcher(t, map[string][]string{"DescribeInstances": {runningInstance}})
+	lc := NewLifecycle(d, NewTentClient(), nil)
+	lc.view.phase = phaseBooting
+	lc.view.since = time.Now().Add(-phaseTimeouts[phaseBooting] - time.Minute)
+	view := lc.Observe()
+	if !errors.Is(view.err, ErrPhaseTimeout) {
+		t.Fatalf("view.err = %v, want it to wrap %v", view.err, ErrPhaseTimeout)
+	}
+	if !strings.HasPrefix(userMessage(view.err), "The server seems stuck") {
+		t.Errorf("userMessage = %q", userMessage(view.err))
+	}
+}
@@ -0,0 +1,298 @@
+package tower
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mansionTent/share"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// phase is where a profile's server is in its life, as far as the tower can tell.
+type phase string
+
+const (
+	phaseStopped     phase = "stopped"
+	phaseLaunching   phase = "launching"
+	phaseBooting     phase = "booting"
+	phaseDownloading phase = "downloading"
+	phaseReady       phase = "in game"
+	phaseDraining    phase = "draining"
+)
+
+// How long each phase may last before we call it stuck. Phases not listed can last forever.
+var phaseTimeouts = map[phase]time.Duration{
+	phaseLaunching:   5 * time.Minute,
+	phaseBooting:     10 * time.Minute,
+	phaseDownloading: 30 * time.Minute,
+}
+
+var ErrPhaseTimeout = errors.New("server is stuck")
+
+// serverView is a consistent snapshot of a lifecycle.
+type serverView struct {
+	known    bool
+	tentUp   bool
+	phase    phase
+	since    time.Time
+	instance string
+	ip       string
+	players  []string
+	version  string
+	started  time.Time
+	progress []share.Progress
+	err      error
+}
+
+// launchable reports whether Start should launch a server: none is running, or the last one got stuck.
+func (v serverView) launchable() bool {
+	return v.phase == phaseStopped || errors.Is(v.err, ErrPhaseTimeout)
+}
+
+// launchAttempt is shared by everyone who asked for a launch while it was in progress.
+type launchAttempt struct {
+	done chan struct{}
+	ip   string
+	err  error
+}
+
+// lifecycle tracks one profile's server from launch to shutdown.
+// It moves forward on what EC2 and the tent report when observed, and on the outcome of launches.
+type lifecycle struct {
+	profile    string
+	dispatcher *dispatcher
+	tent       *tentClient
+	onChange   func()
+	mutex      sync.Mutex
+	view       serverView
+	attempt    *launchAttempt
+	bootSpan   trace.Span    // from a successful launch until the game is up
+	dnsCleared chan struct{} // closed once the last stop's DNS cleanup is done
+}
+
+func NewLifecycle(dispatcher *dispatcher, tent *tentClient, onChange func()) *lifecycle {
+	return &lifecycle{
+		profile:    os.Getenv("EC2_NAME_TAG"),
+		dispatcher: dispatcher,
+		tent:       tent,
+		onChange:   onChange,
+		view:       serverView{phase: phaseStopped, since: time.Now()},
+	}
+}
+
+func (lc *lifecycle) View() serverView {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	return lc.view
+}
+
+// enter moves to a new phase. The caller holds the mutex.
+func (lc *lifecycle) enter(next phase) {
+	if lc.view.phase == next {
+		return
+	}
+	slog.Info("Server phase", "profile", lc.profile, "from", lc.view.phase, "to", next)
+	lc.view.phase = next
+	lc.view.since = time.Now()
+	lc.view.err = nil
+	if lc.bootSpan != nil && (next == phaseReady || next == phaseStopped) {
+		if next == phaseStopped {
+			share.EndSpan(lc.bootSpan, ErrNotRunning)
+		} else {
+			lc.bootSpan.End()
+		}
+		lc.bootSpan = nil
+	}
+	if lc.onChange != nil {
+		go lc.onChange()
+	}
+}
+
+// Launch starts the server, or waits for the launch already in progress and shares its outcome.
+// A server stuck in a phase can be launched again; EC2 still refuses if its instance is around.
+// The launch is traced as part of ctx, or of the first caller's ctx if it was already in progress.
+func (lc *lifecycle) Launch(ctx context.Context) (string, error) {
+	lc.mutex.Lock()
+	attempt := lc.attempt
+	if attempt == nil {
+		if !lc.view.launchable() {
+			ip := lc.view.ip
+			lc.mutex.Unlock()
+			return ip, ErrAlreadyRunning
+		}
+		attempt = &launchAttempt{done: make(chan struct{})}
+		lc.attempt = attempt
+		lc.enter(phaseLaunching)
+		go lc.launch(ctx, attempt, lc.dnsCleared)
+	} else {
+		slog.Debug("Joining launch in progress", "profile", lc.profile)
+	}
+	lc.mutex.Unlock()
+	<-attempt.done
+	return attempt.ip, attempt.err
+}
+
+func (lc *lifecycle) launch(ctx context.Context, attempt *launchAttempt, dnsCleared chan struct{}) {
+	// a cleanup still running from the last stop would otherwise wipe the records this launch sets
+	if dnsCleared != nil {
+		<-dnsCleared
+	}
+	timer := share.NewPerfTimer()
+	ctx, span := share.Tracer.Start(ctx, "launch")
+	server, err := lc.dispatcher.LaunchFactorio(ctx)
+	attempt.ip, attempt.err = server.ip, err
+	share.EndSpan(span, attempt.err)
+	lc.mutex.Lock()
+	lc.attempt = nil
+	metrics.Add("tower_launches_total", 1)
+	if attempt.err != nil {
+		metrics.Add("tower_launch_failures_total", 1)
+		slog.Error("Launch failed", "profile", lc.profile, "err", attempt.err)
+		lc.enter(phaseStopped)
+		lc.view.err = attempt.err
+	} else {
+		metrics.Observe("tower_launch_seconds", timer.Elapsed().Seconds())
+		lc.view.ip = server.ip
+		lc.view.instance = server.instance
+		_, lc.bootSpan = share.Tracer.Start(ctx, "boot")
+		lc.enter(phaseBooting)
+	}
+	lc.mutex.Unlock()
+	close(attempt.done)
+}
+
+// Observe asks EC2 and the tent what's going on, and advances the phase to match.
+func (lc *lifecycle) Observe() serverView {
+	instance, err := lc.dispatcher.FindRunning()
+	var status *share.Status
+	var tentErr error
+	if err == nil && instance != nil && instance.PublicIpAddress != nil {
+		status, tentErr = lc.tent.Status(*instance.PublicIpAddress)
+		if tentErr != nil {
+			slog.Debug("Tent is not reachable", "ip", *instance.PublicIpAddress, "err", tentErr)
+		}
+	}
+
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if err != nil {
+		slog.Warn("Error describing instances", "err", err)
+		lc.view.known = false
+		return lc.view
+	}
+	lc.view.known = true
+	lc.view.tentUp = status != nil
+	if status == nil {
+		lc.view.progress = nil
+	}
+	switch {
+	case instance == nil:
+		if lc.attempt == nil {
+			lc.stopped()
+		}
+	case instance.PublicIpAddress == nil:
+		lc.view.instance = *instance.InstanceId
+		if lc.attempt == nil {
+			lc.enter(phaseLaunching)
+		}
+	case status == nil:
+		lc.view.instance = *instance.InstanceId
+		lc.view.ip = *instance.PublicIpAddress
+		// an unreachable tent is either still booting or already shutting down
+		if lc.view.phase == phaseStopped || lc.view.phase == phaseLaunching {
+			lc.enter(phaseBooting)
+		}
+	default:
+		lc.view.instance = *instance.InstanceId
+		lc.view.ip = *instance.PublicIpAddress
+		lc.apply(status)
+	}
+	if instance != nil && lc.view.started.IsZero() && instance.LaunchTime != nil {
+		lc.view.started = *instance.LaunchTime
+	}
+	lc.checkTimeout()
+	return lc.view
+}
+
+// Report takes a status the tent sent on its own when its state changed, so the phase moves
+// right away instead of on the next Observe.
+func (lc *lifecycle) Report(status *share.Status) {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	// until a launch has finished, or after the instance is gone, only EC2 knows what's going on
+	if lc.attempt != nil || lc.view.phase == phaseStopped {
+		slog.Debug("Ignoring tent report", "profile", lc.profile, "phase", lc.view.phase, "state", status.State)
+		return
+	}
+	lc.view.tentUp = true
+	lc.apply(status)
+	lc.checkTimeout()
+}
+
+// apply advances the phase to match what the tent says. The caller holds the mutex.
+func (lc *lifecycle) apply(status *share.Status) {
+	lc.view.players = status.Players
+	lc.view.version = status.Version
+	lc.view.started = status.Started
+	lc.view.progress = status.Progress
+	switch status.State {
+	case share.StateDownloading, share.StateLaunching:
+		lc.enter(phaseDownloading)
+	case share.StateInGame:
+		lc.enter(phaseReady)
+	case share.StateDraining, share.StateStopped:
+		lc.enter(phaseDraining)
+	}
+}
+
+// stopped resets the view once the instance is gone. The caller holds the mutex.
+func (lc *lifecycle) stopped() {
+	if lc.view.phase == phaseStopped {
+		return
+	}
+	slog.Info("Server has stopped", "profile", lc.profile, "instance", lc.view.instance)
+	lc.enter(phaseStopped)
+	lc.view.instance = ""
+	lc.view.ip = ""
+	lc.view.players = nil
+	lc.view.version = ""
+	lc.view.started = time.Time{}
+	lc.view.progress = nil
+	cleared := make(chan struct{})
+	lc.dnsCleared = cleared
+	go func() {
+		defer close(cleared)
+		err := lc.dispatcher.ClearDnsRecords()
+		if err != nil {
+			slog.Error("Error clearing DNS records", "err", err)
+		}
+	}()
+}
+
+// checkTimeout flags a phase that has gone on for too long. The caller holds the mutex.
+func (lc *lifecycle) checkTimeout() {
+	timeout, ok := phaseTimeouts[lc.view.phase]
+	if !ok || lc.view.err != nil || time.Since(lc.view.since) < timeout {
+		return
+	}
+	lc.view.err = fmt.Errorf("%w: %s for over %s", ErrPhaseTimeout, lc.view.phase, timeout)
+	metrics.Add("tower_phase_timeouts_total", 1, "phase", string(lc.view.phase))
+	slog.Error("Server phase timed out", "profile", lc.profile, "err", lc.view.err)
+	if lc.onChange != nil {
+		go lc.onChange()
+	}
+}
+
+// OnRunningTent calls action with the tent's IP, if there's a tent to talk to.
+func (lc *lifecycle) OnRunningTent(action func(ip string) error) error {
+	view := lc.View()
+	if view.phase != phaseReady && view.phase != phaseDraining {
+		return ErrNotRunning
+	}
+	return action(view.ip)
+}
@@ -0,0 +1,115 @@
+package tower
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/bwmarrin/discordgo"
+)
+
+// logLinkExpiry is how long the links to uploaded logs work.
+const logLinkExpiry = 24 * time.Hour
+
+// onCommandLogs attaches the tail of the live logs, or links the last session's uploaded logs if the server is down.
+func (b *bot) onCommandLogs(i *discordgo.InteractionCreate) {
+	var tail string
+	err := b.lifecycle.OnRunningTent(func(ip string) error {
+		var err error
+		tail, err = b.tent.Logs(ip)
+		return err
+	})
+	if err == nil {
+		content := "Here's the latest from the server."
+		b.session.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+			Files:   []*discordgo.File{{Name: "tail.log", ContentType: "text/plain", Reader: strings.NewReader(tail)}},
+		})
+		return
+	}
+	slog.Debug("No live logs, looking in S3", "err", err)
+	session, links, err := b.dispatcher.LatestLogLinks()
+	if err != nil {
+		slog.Error("Finding logs failed", "err", err)
+		b.replyAmend(i, userMessage(err))
+		return
+	}
+	if len(links) == 0 {
+		b.replyAmend(i, "There are no logs yet.")
+		return
+	}
+	var lines []string
+	for name, link := range links {
+		lines = append(lines, fmt.Sprintf("[%s](%s)", name, link))
+	}
+	slices.Sort(lines)
+	content := ""
+	b.session.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &content,
+		Embeds: &[]*discordgo.MessageEmbed{{
+			Title:       "Logs from " + session,
+			Description: strings.Join(lines, "\n"),
+			Footer:      &discordgo.MessageEmbedFooter{Text: "Links expire in " + logLinkExpiry.String()},
+		}},
+	})
+}
+
+// LatestLogLinks presigns links to the newest file of each log uploaded by the last tent session.
+func (l *dispatcher) LatestLogLinks() (string, map[string]string, error) {
+	prefix := strings.TrimPrefix(l.s3folder.Path+"/logs/", "/")
+	// session names are timestamps, so the newest sorts last, but there may be more than one page of them
+	var latest string
+	err := l.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(l.s3folder.Host),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, session := range page.CommonPrefixes {
+			latest = max(latest, aws.StringValue(session.Prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("listing log sessions: %w", err)
+	}
+	if latest == "" {
+		return "", nil, nil
+	}
+	// game.003.log.gz beats game.002.log.gz, and so on; what's under earlier/ is from other sessions
+	newest := make(map[string]string)
+	err = l.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(l.s3folder.Host),
+		Prefix:    aws.String(latest),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			file := path.Base(*object.Key)
+			log, _, _ := strings.Cut(file, ".")
+			if newest[log] < file {
+				newest[log] = file
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("listing logs: %w", err)
+	}
+	links := make(map[string]string, len(newest))
+	for _, file := range newest {
+		request, _ := l.s3.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(l.s3folder.Host),
+			Key:    aws.String(latest + file),
+		})
+		link, err := request.Presign(logLinkExpiry)
+		if err != nil {
+			return "", nil, fmt.Errorf("presigning %s: %w", file, err)
+		}
+		links[file] = link
+	}
+	return path.Base(latest), links, nil
+}
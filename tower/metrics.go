@@ -0,0 +1,32 @@
+package tower
+
+import (
+	"log/slog"
+	"mansionTent/share"
+	"net/http"
+	"os"
+)
+
+var metrics = share.NewMetrics()
+
+func init() {
+	metrics.Describe("tower_launches_total", share.Counter, "Servers launched.")
+	metrics.Describe("tower_launch_failures_total", share.Counter, "Launches that failed before the instance was up.")
+	metrics.Describe("tower_launch_seconds", share.Histogram, "Time from launch to a running instance with DNS updated.")
+	metrics.Describe("tower_phase_timeouts_total", share.Counter, "Times the server got stuck in a phase, by phase.")
+	metrics.Describe("tower_commands_total", share.Counter, "Discord commands received, by command and action.")
+	metrics.Describe("tower_buttons_total", share.Counter, "Status message buttons pressed, by button.")
+}
+
+// serveMetrics serves /metrics on METRICS_PORT, if it's set.
+func serveMetrics() {
+	port := os.Getenv("METRICS_PORT")
+	if port == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics)
+	slog.Info("Metrics listening", "port", port)
+	err := http.ListenAndServe(":"+port, mux)
+	slog.Error("Metrics port closed", "err", err)
+}
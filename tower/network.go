@@ -0,0 +1,201 @@
+package tower
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"mansionTent/share"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// gamePort is Factorio's default UDP port.
+const gamePort = 34197
+
+// ingressRule is one flattened entry of a security group's inbound rules.
+type ingressRule struct {
+	protocol string
+	port     int64
+	cidr     string
+}
+
+func (r ingressRule) permission() *ec2.IpPermission {
+	permission := &ec2.IpPermission{
+		IpProtocol: aws.String(r.protocol),
+		FromPort:   aws.Int64(r.port),
+		ToPort:     aws.Int64(r.port),
+	}
+	if strings.Contains(r.cidr, ":") {
+		permission.Ipv6Ranges = []*ec2.Ipv6Range{{CidrIpv6: aws.String(r.cidr)}}
+	} else {
+		permission.IpRanges = []*ec2.IpRange{{CidrIp: aws.String(r.cidr)}}
+	}
+	return permission
+}
+
+func flattenPermissions(permissions []*ec2.IpPermission) map[ingressRule]bool {
+	rules := make(map[ingressRule]bool)
+	for _, p := range permissions {
+		protocol, port := aws.StringValue(p.IpProtocol), aws.Int64Value(p.FromPort)
+		for _, r := range p.IpRanges {
+			rules[ingressRule{protocol, port, aws.StringValue(r.CidrIp)}] = true
+		}
+		for _, r := range p.Ipv6Ranges {
+			rules[ingressRule{protocol, port, aws.StringValue(r.CidrIpv6)}] = true
+		}
+	}
+	return rules
+}
+
+// towerAddress is the public IP the tent should accept control connections from.
+func towerAddress() (string, error) {
+	if ip := os.Getenv("TOWER_IP"); ip != "" {
+		return ip, nil
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get("https://checkip.amazonaws.com/")
+	if err != nil {
+		return "", fmt.Errorf("finding the tower's public IP: %w", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("finding the tower's public IP: %w", err)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// wantedIngress is everyone on the game port, and only the tower on the control port.
+func wantedIngress() (map[ingressRule]bool, error) {
+	tower, err := towerAddress()
+	if err != nil {
+		return nil, err
+	}
+	controlPort, err := strconv.Atoi(share.ControlPort())
+	if err != nil {
+		return nil, fmt.Errorf("parsing CONTROL_PORT: %w", err)
+	}
+	return map[ingressRule]bool{
+		{"udp", gamePort, "0.0.0.0/0"}:             true,
+		{"udp", gamePort, "::/0"}:                  true,
+		{"tcp", int64(controlPort), tower + "/32"}: true,
+	}, nil
+}
+
+// vpcID is the configured VPC, the VPC of the configured subnet, or the default VPC.
+func (l *dispatcher) vpcID() (string, error) {
+	if vpc := os.Getenv("EC2_VPC_ID"); vpc != "" {
+		return vpc, nil
+	}
+	if subnet := os.Getenv("EC2_SUBNET_ID"); subnet != "" {
+		resp, err := l.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: []*string{aws.String(subnet)}})
+		if err != nil {
+			return "", fmt.Errorf("describing subnet %s: %w", subnet, err)
+		}
+		if len(resp.Subnets) == 0 {
+			return "", fmt.Errorf("subnet %s not found", subnet)
+		}
+		return *resp.Subnets[0].VpcId, nil
+	}
+	resp, err := l.ec2.DescribeVpcs(&ec2.DescribeVpcsInput{Filters: []*ec2.Filter{{
+		Name:   aws.String("is-default"),
+		Values: []*string{aws.String("true")},
+	}}})
+	if err != nil {
+		return "", fmt.Errorf("describing VPCs: %w", err)
+	}
+	if len(resp.Vpcs) == 0 {
+		return "", fmt.Errorf("no default VPC in %s, set EC2_VPC_ID or EC2_SUBNET_ID", os.Getenv("AWS_REGION"))
+	}
+	return *resp.Vpcs[0].VpcId, nil
+}
+
+// ensureSecurityGroup finds or creates the tent's security group and makes its inbound rules match what we want.
+func (l *dispatcher) ensureSecurityGroup() (string, error) {
+	vpc, err := l.vpcID()
+	if err != nil {
+		return "", err
+	}
+	name := os.Getenv("EC2_NAME_TAG")
+	resp, err := l.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{Filters: []*ec2.Filter{{
+		Name:   aws.String("vpc-id"),
+		Values: []*string{aws.String(vpc)},
+	}, {
+		Name:   aws.String("tag:" + managedTag),
+		Values: []*string{aws.String("security-group")},
+	}, {
+		Name:   aws.String("tag:Name"),
+		Values: []*string{aws.String(name)},
+	}}})
+	if err != nil {
+		return "", fmt.Errorf("describing security groups: %w", err)
+	}
+	var group *ec2.SecurityGroup
+	if len(resp.SecurityGroups) > 0 {
+		group = resp.SecurityGroups[0]
+	} else {
+		created, err := l.ec2.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+			GroupName:   aws.String(name + "-tent"),
+			Description: aws.String("Factorio server managed by mansionTent"),
+			VpcId:       aws.String(vpc),
+			TagSpecifications: []*ec2.TagSpecification{{
+				ResourceType: aws.String(ec2.ResourceTypeSecurityGroup),
+				Tags: []*ec2.Tag{
+					{Key: aws.String("Name"), Value: aws.String(name)},
+					{Key: aws.String(managedTag), Value: aws.String("security-group")},
+				},
+			}},
+		})
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrNoSecurityGroup, err)
+		}
+		slog.Info("Created security group", "id", *created.GroupId, "vpc", vpc)
+		group = &ec2.SecurityGroup{GroupId: created.GroupId}
+	}
+	return *group.GroupId, l.reconcileIngress(group)
+}
+
+func (l *dispatcher) reconcileIngress(group *ec2.SecurityGroup) error {
+	wanted, err := wantedIngress()
+	if err != nil {
+		return err
+	}
+	actual := flattenPermissions(group.IpPermissions)
+	var authorize, revoke []*ec2.IpPermission
+	for rule := range wanted {
+		if !actual[rule] {
+			authorize = append(authorize, rule.permission())
+		}
+	}
+	for rule := range actual {
+		if !wanted[rule] {
+			revoke = append(revoke, rule.permission())
+		}
+	}
+	if len(revoke) > 0 {
+		_, err = l.ec2.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       group.GroupId,
+			IpPermissions: revoke,
+		})
+		if err != nil {
+			return fmt.Errorf("revoking stale rules: %w", err)
+		}
+	}
+	if len(authorize) > 0 {
+		_, err = l.ec2.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       group.GroupId,
+			IpPermissions: authorize,
+		})
+		if err != nil {
+			return fmt.Errorf("authorizing rules: %w", err)
+		}
+	}
+	slog.Debug("Security group reconciled", "id", *group.GroupId, "added", len(authorize), "removed", len(revoke))
+	return nil
+}
@@ -0,0 +1,51 @@
+package tower
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// presenceFor picks the bot's online status and activity text for a server view.
+// When the tent can't be reached we only know what EC2 tells us, so the text stays vague.
+func presenceFor(view serverView) (string, string) {
+	switch {
+	case view.phase == phaseStopped:
+		return string(discordgo.StatusIdle), "Factorio: offline"
+	case !view.tentUp:
+		return string(discordgo.StatusOnline), "Factorio: starting"
+	case view.phase == phaseReady || view.phase == phaseDraining:
+		switch len(view.players) {
+		case 0:
+			return string(discordgo.StatusOnline), "Factorio: empty"
+		case 1:
+			return string(discordgo.StatusOnline), "Factorio: 1 player"
+		default:
+			return string(discordgo.StatusOnline), fmt.Sprintf("Factorio: %d players", len(view.players))
+		}
+	default:
+		return string(discordgo.StatusOnline), "Factorio: " + string(view.phase)
+	}
+}
+
+func (sb *statusBoard) updatePresence(view serverView) {
+	status, text := presenceFor(view)
+	if status+text == sb.presence {
+		return
+	}
+	err := sb.bot.session.UpdateStatusComplex(discordgo.UpdateStatusData{
+		Status: status,
+		Activities: []*discordgo.Activity{{
+			Name:  text,
+			Type:  discordgo.ActivityTypeCustom,
+			State: text,
+		}},
+	})
+	if err != nil {
+		slog.Warn("Error updating presence", "err", err)
+		return
+	}
+	slog.Debug("Presence updated", "status", status, "text", text)
+	sb.presence = status + text
+}
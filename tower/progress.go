@@ -0,0 +1,68 @@
+package tower
+
+import (
+	"fmt"
+	"log/slog"
+	"mansionTent/share"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	progressPoll = 5 * time.Second
+	// Discord stops accepting edits to an interaction response after 15 minutes.
+	progressDeadline = 14 * time.Minute
+	progressBarWidth = 20
+)
+
+func progressBar(p share.Progress) string {
+	if p.Total <= 0 {
+		return fmt.Sprintf("%s…", p.Task)
+	}
+	filled := int(min(p.Done*progressBarWidth/p.Total, progressBarWidth))
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", progressBarWidth-filled)
+	amount := fmt.Sprintf("%d/%d %s", p.Done, p.Total, p.Unit)
+	if p.Unit == "bytes" {
+		amount = fmt.Sprintf("%.0f/%.0f MB", float64(p.Done)/1e6, float64(p.Total)/1e6)
+	}
+	return fmt.Sprintf("%s\n`%s` %d%% (%s)", p.Task, bar, p.Done*100/p.Total, amount)
+}
+
+func bootMessage(ip string, view serverView) string {
+	lines := []string{fmt.Sprintf("Factorio server starting at `%s` (`%s`)", os.Getenv("ROUTE53_FQDN"), ip)}
+	switch {
+	case view.err != nil:
+		lines = append(lines, userMessage(view.err))
+	case view.phase == phaseReady:
+		lines[0] = fmt.Sprintf("Factorio server is ready at `%s` (`%s`)", os.Getenv("ROUTE53_FQDN"), ip)
+	case len(view.progress) > 0:
+		for _, p := range view.progress {
+			lines = append(lines, progressBar(p))
+		}
+	default:
+		lines = append(lines, string(view.phase)+"…")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// followBoot keeps editing the reply to /factorio with boot progress until the game is up, or it's too late to edit.
+func (b *bot) followBoot(i *discordgo.InteractionCreate, ip string) {
+	deadline := time.Now().Add(progressDeadline)
+	var last string
+	for time.Now().Before(deadline) {
+		view := b.lifecycle.Observe()
+		msg := bootMessage(ip, view)
+		if msg != last {
+			b.replyAmend(i, msg)
+			last = msg
+		}
+		if view.phase == phaseReady || view.phase == phaseStopped || view.err != nil {
+			return
+		}
+		time.Sleep(progressPoll)
+	}
+	slog.Debug("Stopped following boot progress", "ip", ip)
+}
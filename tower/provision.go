@@ -0,0 +1,79 @@
+package tower
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// RunProvision and RunTeardown only touch AWS resources, so unlike a launch they don't publish
+// the tent's config or upload its binaries.
+func RunProvision() {
+	l, err := newDispatcher()
+	if err == nil {
+		err = l.Provision()
+	}
+	if err != nil {
+		slog.Error("Error provisioning", "err", err)
+		panic(err)
+	}
+}
+
+func RunTeardown() {
+	l, err := newDispatcher()
+	if err == nil {
+		err = l.Teardown()
+	}
+	if err != nil {
+		slog.Error("Error tearing down", "err", err)
+		panic(err)
+	}
+}
+
+// Provision sets up everything a launch needs ahead of time, so the first launch is as quick as any other.
+// It's safe to run again; existing resources are reused and reconciled.
+func (l *dispatcher) Provision() error {
+	group, err := l.ensureSecurityGroup()
+	if err != nil {
+		return fmt.Errorf("provisioning security group: %w", err)
+	}
+	slog.Info("Security group ready", "id", group)
+	if dataVolumeSize() > 0 {
+		volume, err := l.findOrCreateDataVolume()
+		if err != nil {
+			return fmt.Errorf("provisioning data volume: %w", err)
+		}
+		slog.Info("Data volume ready", "id", *volume.VolumeId, "az", *volume.AvailabilityZone)
+	}
+	if useElasticIP() {
+		address, err := l.findOrAllocateElasticIP()
+		if err != nil {
+			return fmt.Errorf("provisioning elastic IP: %w", err)
+		}
+		slog.Info("Elastic IP ready", "ip", *address.PublicIp)
+	}
+	return nil
+}
+
+// Teardown removes what Provision made that costs money or sticks around on its own.
+// The data volume is left alone, since it holds the only copy of anything not yet synced to S3.
+func (l *dispatcher) Teardown() error {
+	instance, err := l.FindRunning()
+	if err != nil {
+		return err
+	}
+	if instance != nil {
+		return fmt.Errorf("%w: stop %s first", ErrAlreadyRunning, *instance.InstanceId)
+	}
+	err = l.releaseElasticIP()
+	if err != nil {
+		return err
+	}
+	err = l.deleteConfig()
+	if err != nil {
+		return err
+	}
+	if dataVolumeSize() > 0 {
+		slog.Info("Keeping the data volume; delete it in the EC2 console if you really mean it")
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package tower
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mansionTent/share"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/joho/godotenv"
+)
+
+// tentSettingKeys are the mt.env settings the tent reads. A trailing * stands for a family of them.
+var tentSettingKeys = []string{
+	"LOG_LEVEL", "LOG_FORMAT", "LOG_ROTATE_MB", "LOG_KEEP_FILES",
+	"AWS_REGION", "AWS_REGION_S3", "S3_FOLDER_URL", "ROUTE53_FQDN", "EC2_INSTANCE_TYPE",
+	"WEBHOOK_URL", "WEBHOOK_EVENTS", "WEBHOOK_COALESCE_SECONDS", "WEBHOOK_MAX_RETRIES",
+	"SLACK_WEBHOOK_URL", "SLACK_EVENTS",
+	"MATRIX_HOMESERVER", "MATRIX_ROOM_ID", "MATRIX_ACCESS_TOKEN", "MATRIX_EVENTS",
+	"NTFY_TOPIC_URL", "NTFY_TOKEN", "NTFY_EVENTS",
+	"JSON_WEBHOOK_URL", "JSON_WEBHOOK_SECRET", "JSON_WEBHOOK_EVENTS",
+	"HOOK_TEMPLATE_*", "HOOK_EVENTS_DISABLED",
+	"CONTROL_PORT", "CONTROL_TOKEN", "SHUTDOWN_GRACE_INITIAL_MINUTES", "SHUTDOWN_GRACE_DRAINED_MINUTES",
+	"FACTORIO_VERSION", "FACTORIO_ARM64_PLATFORM", "FACTORIO_EMULATOR",
+	"SYNC_INCLUDE", "SYNC_EXCLUDE", "SYNC_PART_MB", "SYNC_CONCURRENCY", "SYNC_FILE_CONCURRENCY",
+	"RCON_PORT", "UPS_SAMPLE_SECONDS", "UPS_WINDOW_MINUTES", "UPS_ALERT_THRESHOLD",
+	"SAVE_INTERVAL_MINUTES", "OTEL_*",
+}
+
+// towerSettingKeys stay with the tower, like BOT_TOKEN, the DNS credentials and any AWS keys.
+// A setting in neither list is a typo or a new setting nobody sorted yet, and is left out with a warning.
+var towerSettingKeys = []string{
+	"BOT_TOKEN", "GUILD_ID", "CHANNEL_ID", "DM_CHANNEL_ID", "STATUS_POLL_SECONDS",
+	"METRICS_PORT", "CALLBACK_PORT", "TOWER_IP", "CONFIG_STORE", "CONFIG_PATH",
+	"DNS_PROVIDER", "DNS_PLACEHOLDER_IP", "ROUTE53_ZONE_ID", "CLOUDFLARE_*", "RFC2136_*",
+	"EC2_*", "EBS_DATA_VOLUME_GB", "USERDATA_*", "AWS_*",
+}
+
+// secretSettingKeys are the tent settings anyone who can describe the instance shouldn't be able to read,
+// which they can if they're in its user-data.
+var secretSettingKeys = []string{
+	"WEBHOOK_URL", "SLACK_WEBHOOK_URL", "MATRIX_ACCESS_TOKEN", "NTFY_TOKEN", "JSON_WEBHOOK_URL", "JSON_WEBHOOK_SECRET",
+	"CONTROL_TOKEN", "OTEL_EXPORTER_OTLP_HEADERS",
+}
+
+// matchSetting reports whether key is one of keys, or in a family of them.
+func matchSetting(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key || strings.HasSuffix(k, "*") && strings.HasPrefix(key, strings.TrimSuffix(k, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+var ErrUnknownConfigStore = errors.New("unknown CONFIG_STORE")
+
+// configStore is where the tent's settings are kept: ssm (the default) and secretsmanager keep them out of
+// the instance's user-data but need EC2_IAM_ROLE to be able to read them, while userdata embeds them in it.
+func configStore() string {
+	store := strings.ToLower(os.Getenv("CONFIG_STORE"))
+	if store == "" {
+		return share.ConfigStoreSSM
+	}
+	return store
+}
+
+// configPath is the SSM parameter path, or the Secrets Manager secret name, holding the tent's settings.
+func configPath() string {
+	path := os.Getenv("CONFIG_PATH")
+	if path == "" {
+		path = "/mansionTent/" + os.Getenv("EC2_NAME_TAG")
+	}
+	if configStore() == share.ConfigStoreSecretsManager {
+		return strings.Trim(path, "/")
+	}
+	return "/" + strings.Trim(path, "/") + "/"
+}
+
+// tentSettings reads mt.env and keeps only what the tent needs.
+func tentSettings() (map[string]string, error) {
+	values, err := godotenv.Read("mt.env")
+	if err != nil {
+		return nil, fmt.Errorf("reading mt.env: %w", err)
+	}
+	return filterTentSettings(values), nil
+}
+
+func filterTentSettings(values map[string]string) map[string]string {
+	settings := make(map[string]string)
+	var unknown []string
+	for key, value := range values {
+		switch {
+		case matchSetting(tentSettingKeys, key):
+			settings[key] = value
+		case !matchSetting(towerSettingKeys, key):
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		slog.Warn("Not sending settings the tower doesn't know to the tent", "keys", strings.Join(unknown, ", "))
+	}
+	return settings
+}
+
+// secretsIn lists the secret settings that are set, sorted.
+func secretsIn(settings map[string]string) []string {
+	var secrets []string
+	for _, key := range secretSettingKeys {
+		if settings[key] != "" {
+			secrets = append(secrets, key)
+		}
+	}
+	slices.Sort(secrets)
+	return secrets
+}
+
+// publishConfig stores the tent's settings and returns the mt.env the user-data should write,
+// which is just enough for the tent to fetch the rest.
+func (l *dispatcher) publishConfig() (map[string]string, error) {
+	settings, err := tentSettings()
+	if err != nil {
+		return nil, err
+	}
+	store := configStore()
+	switch store {
+	case share.ConfigStoreUserData:
+		if secrets := secretsIn(settings); len(secrets) > 0 {
+			slog.Warn("CONFIG_STORE=userdata puts secrets in the instance's user-data, where anyone who can describe it "+
+				"can read them; use ssm or secretsmanager instead", "keys", strings.Join(secrets, ", "))
+		}
+	case share.ConfigStoreSSM:
+		err = l.putParameters(settings)
+	case share.ConfigStoreSecretsManager:
+		err = l.putSecret(settings)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownConfigStore, store)
+	}
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Published tent config", "store", store, "path", configPath(), "settings", len(settings))
+	return bootstrapEnv(settings), nil
+}
+
+// bootstrapEnv is the mt.env that goes in the user-data for these settings.
+func bootstrapEnv(settings map[string]string) map[string]string {
+	if configStore() == share.ConfigStoreUserData {
+		return settings
+	}
+	return map[string]string{
+		"LOG_LEVEL":       settings["LOG_LEVEL"],
+		"AWS_REGION":      os.Getenv("AWS_REGION"),
+		"MT_CONFIG_STORE": configStore(),
+		"MT_CONFIG_PATH":  configPath(),
+	}
+}
+
+// putParameters writes one SecureString per setting and removes parameters for settings that are gone.
+func (l *dispatcher) putParameters(settings map[string]string) error {
+	path := configPath()
+	for key, value := range settings {
+		if value == "" {
+			// SSM won't store an empty value, and unset reads the same to the tent
+			continue
+		}
+		_, err := l.ssm.PutParameter(&ssm.PutParameterInput{
+			Name:      aws.String(path + key),
+			Value:     aws.String(value),
+			Type:      aws.String(ssm.ParameterTypeSecureString),
+			Overwrite: aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("putting parameter %s: %w", path+key, err)
+		}
+	}
+	return l.deleteParameters(func(key string) bool {
+		return settings[key] == ""
+	})
+}
+
+// deleteParameters removes the parameters under configPath whose setting name matches stale.
+func (l *dispatcher) deleteParameters(stale func(key string) bool) error {
+	path := configPath()
+	var names []*string
+	err := l.ssm.GetParametersByPathPages(&ssm.GetParametersByPathInput{
+		Path: aws.String(path),
+	}, func(page *ssm.GetParametersByPathOutput, _ bool) bool {
+		for _, parameter := range page.Parameters {
+			if stale(strings.TrimPrefix(*parameter.Name, path)) {
+				names = append(names, parameter.Name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("listing parameters under %s: %w", path, err)
+	}
+	// DeleteParameters takes at most ten names at a time
+	for len(names) > 0 {
+		batch := names[:min(10, len(names))]
+		names = names[len(batch):]
+		_, err = l.ssm.DeleteParameters(&ssm.DeleteParametersInput{Names: batch})
+		if err != nil {
+			return fmt.Errorf("deleting parameters under %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// putSecret stores all the settings as one JSON secret, creating it the first time.
+func (l *dispatcher) putSecret(settings map[string]string) error {
+	name := configPath()
+	marshalled, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("marshalling secret %s: %w", name, err)
+	}
+	_, err = l.secrets.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(name),
+		SecretString: aws.String(string(marshalled)),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+		_, err = l.secrets.CreateSecret(&secretsmanager.CreateSecretInput{
+			Name:         aws.String(name),
+			SecretString: aws.String(string(marshalled)),
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("putting secret %s: %w", name, err)
+	}
+	return nil
+}
+
+// deleteConfig removes the stored settings, so nothing is left behind after a teardown.
+func (l *dispatcher) deleteConfig() error {
+	switch configStore() {
+	case share.ConfigStoreSSM:
+		return l.deleteParameters(func(string) bool { return true })
+	case share.ConfigStoreSecretsManager:
+		_, err := l.secrets.DeleteSecret(&secretsmanager.DeleteSecretInput{
+			SecretId:                   aws.String(configPath()),
+			ForceDeleteWithoutRecovery: aws.Bool(true),
+		})
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("deleting secret %s: %w", configPath(), err)
+		}
+	}
+	return nil
+}
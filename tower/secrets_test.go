@@ -0,0 +1,82 @@
+package tower
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestFilterTentSettings(t *testing.T) {
+	settings := filterTentSettings(map[string]string{
+		"BOT_TOKEN":             "secret",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"RFC2136_TSIG_SECRET":   "secret",
+		"EC2_INSTANCE_TYPE":     "c7a.large",
+		"EC2_NAME_TAG":          "Factorio",
+		"AWS_REGION":            "us-east-1",
+		"HOOK_TEMPLATE_JOINED":  "hi {{.Player}}",
+		"OTEL_SERVICE_NAME":     "tent",
+		"WEBHOK_URL":            "typo",
+	})
+	for _, key := range []string{"EC2_INSTANCE_TYPE", "AWS_REGION", "HOOK_TEMPLATE_JOINED", "OTEL_SERVICE_NAME"} {
+		if _, ok := settings[key]; !ok {
+			t.Errorf("%s wasn't sent to the tent", key)
+		}
+	}
+	for _, key := range []string{"BOT_TOKEN", "AWS_SECRET_ACCESS_KEY", "RFC2136_TSIG_SECRET", "EC2_NAME_TAG", "WEBHOK_URL"} {
+		if _, ok := settings[key]; ok {
+			t.Errorf("%s was sent to the tent", key)
+		}
+	}
+}
+
+func TestSecretsIn(t *testing.T) {
+	got := secretsIn(map[string]string{"CONTROL_TOKEN": "t", "WEBHOOK_URL": "https://example.com/hook", "NTFY_TOKEN": "", "AWS_REGION": "us-east-1"})
+	if want := []string{"CONTROL_TOKEN", "WEBHOOK_URL"}; !slices.Equal(got, want) {
+		t.Errorf("secretsIn() = %v, want %v", got, want)
+	}
+	for _, key := range secretSettingKeys {
+		if !matchSetting(tentSettingKeys, key) {
+			t.Errorf("%s is a secret the tent doesn't read", key)
+		}
+	}
+}
+
+// Every setting documented in example.env, commented out or not, belongs to the tower or the tent.
+func TestExampleEnvSettingsAreSorted(t *testing.T) {
+	data, err := os.ReadFile("../example.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, match := range regexp.MustCompile(`(?m)^#?([A-Z][A-Z0-9_]*)=`).FindAllStringSubmatch(string(data), -1) {
+		key := match[1]
+		if !matchSetting(tentSettingKeys, key) && !matchSetting(towerSettingKeys, key) {
+			t.Errorf("%s is in example.env but in neither tentSettingKeys nor towerSettingKeys", key)
+		}
+	}
+}
+
+// Every setting the tent reads is one the tower sends it, apart from what systemd and the tower set at launch.
+func TestTentSettingsCoverWhatTheTentReads(t *testing.T) {
+	fromLaunch := []string{"NOTIFY_SOCKET", "WATCHDOG_PID", "WATCHDOG_USEC", "JOURNAL_STREAM", "TRACEPARENT", "MT_*"}
+	read := regexp.MustCompile(`(?:Getenv|LookupEnv|OrDefault|parseEventKinds)\("([A-Z][A-Z0-9_]*)"`)
+	files, err := filepath.Glob("../tent/*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _ := filepath.Glob("../share/*.go")
+	for _, file := range append(append(files, shared...), "../main.go") {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range read.FindAllStringSubmatch(string(data), -1) {
+			key := match[1]
+			if !matchSetting(tentSettingKeys, key) && !matchSetting(fromLaunch, key) {
+				t.Errorf("%s reads %s, which isn't in tentSettingKeys", filepath.Base(file), key)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package tower
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	statusTitle = "Factorio server"
+	buttonStart = "status:start"
+	buttonStop  = "status:stop"
+	buttonSave  = "status:save"
+)
+
+var phaseColors = map[phase]int{
+	phaseStopped:     0x747f8d,
+	phaseLaunching:   0xfaa61a,
+	phaseBooting:     0xfaa61a,
+	phaseDownloading: 0xfaa61a,
+	phaseReady:       0x43b581,
+	phaseDraining:    0x5865f2,
+}
+
+// errorColor replaces the phase color while the lifecycle reports an error.
+const errorColor = 0xed4245
+
+type statusBoard struct {
+	bot       *bot
+	messageID string
+	last      string
+	presence  string
+	poke      chan struct{}
+	interval  time.Duration
+}
+
+func NewStatusBoard(b *bot) *statusBoard {
+	seconds, err := strconv.Atoi(os.Getenv("STATUS_POLL_SECONDS"))
+	if err != nil || seconds <= 0 {
+		seconds = 30
+	}
+	return &statusBoard{
+		bot:      b,
+		poke:     make(chan struct{}, 1),
+		interval: time.Duration(seconds) * time.Second,
+	}
+}
+
+// Poke asks the board to refresh as soon as possible, without waiting for the next poll.
+func (sb *statusBoard) Poke() {
+	select {
+	case sb.poke <- struct{}{}:
+	default:
+	}
+}
+
+func (sb *statusBoard) Run() {
+	if sb.bot.ids.channel == "" {
+		slog.Warn("CHANNEL_ID is not set, status message disabled")
+	} else {
+		sb.messageID = sb.findMessage()
+	}
+	ticker := time.NewTicker(sb.interval)
+	defer ticker.Stop()
+	for {
+		view := sb.bot.lifecycle.Observe()
+		if view.known {
+			sb.updatePresence(view)
+		}
+		if sb.bot.ids.channel != "" {
+			sb.refresh(view)
+		}
+		select {
+		case <-ticker.C:
+		case <-sb.poke:
+		}
+	}
+}
+
+// findMessage looks for a status message left behind by a previous run, so restarts don't litter the channel.
+func (sb *statusBoard) findMessage() string {
+	messages, err := sb.bot.session.ChannelMessages(sb.bot.ids.channel, 50, "", "", "")
+	if err != nil {
+		slog.Warn("Error reading channel history", "err", err)
+		return ""
+	}
+	for _, message := range messages {
+		if message.Author == nil || message.Author.ID != sb.bot.session.State.User.ID {
+			continue
+		}
+		if len(message.Embeds) > 0 && message.Embeds[0].Title == statusTitle {
+			slog.Debug("Reusing status message", "id", message.ID)
+			return message.ID
+		}
+	}
+	return ""
+}
+
+func (sb *statusBoard) refresh(view serverView) {
+	embed, components := sb.render(view)
+	rendered, _ := json.Marshal([]any{embed, components})
+	key := string(rendered)
+	if sb.messageID != "" && key == sb.last {
+		return
+	}
+	var err error
+	if sb.messageID == "" {
+		var message *discordgo.Message
+		message, err = sb.bot.session.ChannelMessageSendComplex(sb.bot.ids.channel, &discordgo.MessageSend{
+			Embeds:     []*discordgo.MessageEmbed{embed},
+			Components: components,
+		})
+		if err == nil {
+			sb.messageID = message.ID
+		}
+	} else {
+		_, err = sb.bot.session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			Channel:    sb.bot.ids.channel,
+			ID:         sb.messageID,
+			Embeds:     []*discordgo.MessageEmbed{embed},
+			Components: components,
+		})
+	}
+	if err != nil {
+		slog.Error("Error updating status message", "err", err)
+		return
+	}
+	sb.last = key
+}
+
+func (sb *statusBoard) render(view serverView) (*discordgo.MessageEmbed, []discordgo.MessageComponent) {
+	address := "—"
+	if view.ip != "" {
+		address = fmt.Sprintf("`%s` (`%s`)", os.Getenv("ROUTE53_FQDN"), view.ip)
+	}
+	players := "—"
+	if len(view.players) > 0 {
+		players = strings.Join(view.players, ", ")
+	}
+	version := view.version
+	if version == "" {
+		version = "—"
+	}
+	uptime := "—"
+	if !view.started.IsZero() && view.phase != phaseStopped {
+		uptime = time.Since(view.started).Round(time.Minute).String()
+	}
+	embed := &discordgo.MessageEmbed{
+		Title: statusTitle,
+		Color: phaseColors[view.phase],
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "State", Value: string(view.phase), Inline: true},
+			{Name: "Version", Value: version, Inline: true},
+			{Name: "Uptime", Value: uptime, Inline: true},
+			{Name: "Address", Value: address},
+			{Name: fmt.Sprintf("Players (%d)", len(view.players)), Value: players},
+		},
+	}
+	if view.err != nil {
+		embed.Color = errorColor
+		embed.Description = "⚠️ " + view.err.Error()
+	}
+	running := view.phase == phaseReady || view.phase == phaseDraining
+	components := []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+		discordgo.Button{Label: "Start", Style: discordgo.SuccessButton, CustomID: buttonStart,
+			Disabled: !view.launchable()},
+		discordgo.Button{Label: "Stop", Style: discordgo.DangerButton, CustomID: buttonStop,
+			Disabled: !running},
+		discordgo.Button{Label: "Save", Style: discordgo.SecondaryButton, CustomID: buttonSave,
+			Disabled: !running},
+	}}}
+	return embed, components
+}
@@ -0,0 +1,28 @@
+package tower
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestStartButtonRecoversAStuckServer(t *testing.T) {
+	cases := []struct {
+		name    string
+		view    serverView
+		enabled bool
+	}{
+		{"stopped", serverView{phase: phaseStopped}, true},
+		{"booting", serverView{phase: phaseBooting}, false},
+		{"ready", serverView{phase: phaseReady}, false},
+		{"stuck booting", serverView{phase: phaseBooting, err: fmt.Errorf("%w: booting", ErrPhaseTimeout)}, true},
+	}
+	for _, c := range cases {
+		_, components := (&statusBoard{}).render(c.view)
+		start := components[0].(discordgo.ActionsRow).Components[0].(discordgo.Button)
+		if start.Disabled == c.enabled {
+			t.Errorf("%s: Start disabled = %v, want %v", c.name, start.Disabled, !c.enabled)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package tower
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mansionTent/share"
+	"net/http"
+	"time"
+)
+
+type tentClient struct {
+	http  *http.Client
+	slow  *http.Client // for requests that wait on the game, like a save and its upload
+	token string
+	port  string
+}
+
+func NewTentClient() *tentClient {
+	return &tentClient{
+		http:  &http.Client{Timeout: 5 * time.Second},
+		slow:  &http.Client{Timeout: 3 * time.Minute},
+		token: share.ControlToken(),
+		port:  share.ControlPort(),
+	}
+}
+
+func (c *tentClient) do(method, ip, path string) (*http.Response, error) {
+	return c.doWith(c.http, method, ip, path)
+}
+
+func (c *tentClient) doWith(client *http.Client, method, ip, path string) (*http.Response, error) {
+	request, err := http.NewRequest(method, "http://"+ip+":"+c.port+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.token)
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		response.Body.Close()
+		return nil, fmt.Errorf("tent %s %s: %s", method, path, response.Status)
+	}
+	return response, nil
+}
+
+func (c *tentClient) Status(ip string) (*share.Status, error) {
+	response, err := c.do(http.MethodGet, ip, "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	status := &share.Status{}
+	err = json.NewDecoder(response.Body).Decode(status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (c *tentClient) Stop(ip string) error {
+	response, err := c.do(http.MethodPost, ip, "/stop")
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// SaveAndWait saves the game and returns once the save is uploaded.
+func (c *tentClient) SaveAndWait(ip string) (*share.SaveResult, error) {
+	response, err := c.doWith(c.slow, http.MethodPost, ip, "/save?wait=true")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	result := &share.SaveResult{}
+	err = json.NewDecoder(response.Body).Decode(result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *tentClient) Save(ip string) error {
+	response, err := c.do(http.MethodPost, ip, "/save")
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// Logs returns the tail of the game and tent logs.
+func (c *tentClient) Logs(ip string) (string, error) {
+	response, err := c.do(http.MethodGet, ip, "/logs")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	tail, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(tail), nil
+}
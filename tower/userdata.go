@@ -0,0 +1,141 @@
+package tower
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/joho/godotenv"
+)
+
+//go:embed userdata.yaml.tmpl
+var defaultUserDataTemplate string
+
+// userDataConfig is what the cloud-init template gets to work with.
+type userDataConfig struct {
+	Env        string // mt.env, base64-encoded
+	Dir        string // where mt.env, the binary and snippets go
+	Binary     string
+	BinaryURL  string
+	User       string
+	WorkDir    string // the tent's cwd, where the game and saves live
+	DataDevice string // the data volume to mount on WorkDir, if any
+	Packages   []string
+	SwapBytes  int64
+	Systemd    bool
+	CloudWatch bool
+	Snippets   []string // extra shell scripts, base64-encoded, run before the tent starts
+}
+
+func RunUserData() {
+	l, err := newDispatcher()
+	if err != nil {
+		slog.Error("Error creating dispatcher", "err", err)
+		panic(err)
+	}
+	// render without publishing anything, so this is safe to run while a tent is up
+	settings, err := tentSettings()
+	if err == nil {
+		var rendered string
+		rendered, err = l.renderUserData(bootstrapEnv(settings))
+		fmt.Print(rendered)
+	}
+	if err != nil {
+		slog.Error("Error rendering user-data", "err", err)
+		panic(err)
+	}
+}
+
+// splitList splits a comma-separated setting, dropping blanks.
+func splitList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (l *dispatcher) userDataConfig(env map[string]string) (*userDataConfig, error) {
+	marshalled, err := godotenv.Marshal(env)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling mt.env: %w", err)
+	}
+	c := &userDataConfig{
+		Env:        base64.StdEncoding.EncodeToString([]byte(marshalled + "\n")),
+		Dir:        "/opt/mansionTent",
+		BinaryURL:  os.Getenv("S3_FOLDER_URL") + "/" + l.arch.binaryName(),
+		User:       os.Getenv("USERDATA_USER"),
+		Packages:   splitList("USERDATA_PACKAGES"),
+		CloudWatch: os.Getenv("USERDATA_CLOUDWATCH") == "true",
+	}
+	c.Binary = c.Dir + "/" + l.arch.binaryName()
+	if c.User == "" {
+		c.User = "ec2-user"
+	}
+	c.WorkDir = "/home/" + c.User
+	if dataVolumeSize() > 0 {
+		c.WorkDir = "/data"
+		c.DataDevice = dataVolumeDevice
+	}
+	switch os.Getenv("USERDATA_SERVICE") {
+	case "", "screen":
+		c.Packages = append(c.Packages, "screen")
+	case "systemd":
+		c.Systemd = true
+	default:
+		return nil, fmt.Errorf("unknown USERDATA_SERVICE: %s", os.Getenv("USERDATA_SERVICE"))
+	}
+	if c.CloudWatch {
+		c.Packages = append(c.Packages, "amazon-cloudwatch-agent")
+	}
+	if str := os.Getenv("USERDATA_SWAP_MB"); str != "" {
+		mb, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing USERDATA_SWAP_MB: %w", err)
+		}
+		c.SwapBytes = mb << 20
+	}
+	for _, path := range splitList("USERDATA_SNIPPETS") {
+		snippet, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading snippet: %w", err)
+		}
+		c.Snippets = append(c.Snippets, base64.StdEncoding.EncodeToString(snippet))
+	}
+	return c, nil
+}
+
+// renderUserData fills in the cloud-init template, USERDATA_TEMPLATE if set or the built-in one.
+func (l *dispatcher) renderUserData(env map[string]string) (string, error) {
+	text := defaultUserDataTemplate
+	if path := os.Getenv("USERDATA_TEMPLATE"); path != "" {
+		custom, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading user-data template: %w", err)
+		}
+		text = string(custom)
+	}
+	tmpl, err := template.New("userdata").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parsing user-data template: %w", err)
+	}
+	c, err := l.userDataConfig(env)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, c)
+	if err != nil {
+		return "", fmt.Errorf("rendering user-data template: %w", err)
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,122 @@
+package tower
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	// dataVolumeDevice is where the data volume is attached; Amazon Linux links it to the real NVMe device.
+	dataVolumeDevice = "/dev/sdf"
+	// managedTag marks the resources we manage, e.g. our data volume apart from the root volumes, which share the Name tag.
+	managedTag = "mansionTent"
+)
+
+// dataVolumeSize is the size of the persistent data volume in GiB, or zero to keep everything on the root volume.
+func dataVolumeSize() int64 {
+	str := os.Getenv("EBS_DATA_VOLUME_GB")
+	if str == "" {
+		return 0
+	}
+	size, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		slog.Warn("Invalid integer", "key", "EBS_DATA_VOLUME_GB", "value", str, "err", err)
+		return 0
+	}
+	return size
+}
+
+// findOrCreateDataVolume returns the tagged data volume, creating an empty one if this is the first launch.
+// The instance has to be launched in the volume's availability zone.
+func (l *dispatcher) findOrCreateDataVolume() (*ec2.Volume, error) {
+	resp, err := l.ec2.DescribeVolumes(&ec2.DescribeVolumesInput{Filters: []*ec2.Filter{{
+		Name:   aws.String("tag:Name"),
+		Values: []*string{aws.String(os.Getenv("EC2_NAME_TAG"))},
+	}, {
+		Name:   aws.String("tag:" + managedTag),
+		Values: []*string{aws.String("data")},
+	}}})
+	if err != nil {
+		return nil, fmt.Errorf("describing volumes: %w", err)
+	}
+	for _, volume := range resp.Volumes {
+		if *volume.State != ec2.VolumeStateDeleting && *volume.State != ec2.VolumeStateDeleted {
+			slog.Debug("Found data volume", "id", *volume.VolumeId, "az", *volume.AvailabilityZone, "state", *volume.State)
+			return volume, nil
+		}
+	}
+	zone, err := l.availabilityZone()
+	if err != nil {
+		return nil, err
+	}
+	volume, err := l.ec2.CreateVolume(&ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(zone),
+		Size:             aws.Int64(dataVolumeSize()),
+		VolumeType:       aws.String(ec2.VolumeTypeGp3),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeVolume),
+			Tags: []*ec2.Tag{
+				{Key: aws.String("Name"), Value: aws.String(os.Getenv("EC2_NAME_TAG"))},
+				{Key: aws.String(managedTag), Value: aws.String("data")},
+			},
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating data volume: %w", err)
+	}
+	slog.Info("Created data volume", "id", *volume.VolumeId, "az", zone, "size", *volume.Size)
+	err = l.ec2.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{VolumeIds: []*string{volume.VolumeId}})
+	if err != nil {
+		return nil, fmt.Errorf("waiting for data volume: %w", err)
+	}
+	return volume, nil
+}
+
+func (l *dispatcher) availabilityZone() (string, error) {
+	if zone := os.Getenv("EC2_AVAILABILITY_ZONE"); zone != "" {
+		return zone, nil
+	}
+	if subnet := os.Getenv("EC2_SUBNET_ID"); subnet != "" {
+		resp, err := l.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{SubnetIds: []*string{aws.String(subnet)}})
+		if err != nil {
+			return "", fmt.Errorf("describing subnet %s: %w", subnet, err)
+		}
+		if len(resp.Subnets) > 0 {
+			return *resp.Subnets[0].AvailabilityZone, nil
+		}
+	}
+	resp, err := l.ec2.DescribeAvailabilityZones(&ec2.DescribeAvailabilityZonesInput{Filters: []*ec2.Filter{{
+		Name:   aws.String("state"),
+		Values: []*string{aws.String(ec2.AvailabilityZoneStateAvailable)},
+	}}})
+	if err != nil {
+		return "", fmt.Errorf("describing availability zones: %w", err)
+	}
+	if len(resp.AvailabilityZones) == 0 {
+		return "", fmt.Errorf("no availability zone available in %s", os.Getenv("AWS_REGION"))
+	}
+	return *resp.AvailabilityZones[0].ZoneName, nil
+}
+
+func (l *dispatcher) attachDataVolume(volume *ec2.Volume, instanceID string) error {
+	// a volume can still be detaching from an instance that just terminated
+	err := l.ec2.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{VolumeIds: []*string{volume.VolumeId}})
+	if err != nil {
+		return fmt.Errorf("waiting for data volume: %w", err)
+	}
+	_, err = l.ec2.AttachVolume(&ec2.AttachVolumeInput{
+		Device:     aws.String(dataVolumeDevice),
+		InstanceId: aws.String(instanceID),
+		VolumeId:   volume.VolumeId,
+	})
+	if err != nil {
+		return fmt.Errorf("attaching data volume: %w", err)
+	}
+	slog.Debug("Attached data volume", "id", *volume.VolumeId, "instance", instanceID)
+	return nil
+}